@@ -1,3 +1,5 @@
 module net-cat
 
 go 1.23.1
+
+require golang.org/x/text v0.21.0
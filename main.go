@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"net-cat/utilities"
 )
 
@@ -12,6 +13,34 @@ func main() {
 		return
 	}
 
+	// Read the optional config file
+	if err := utilities.LoadConfig(); err != nil {
+		fmt.Println(err)
+		logger.Log("error", err.Error())
+		return
+	}
+
+	// Accounts come first, direct messages are only kept for registered users
+	if err := utilities.InitAccounts(); err != nil {
+		fmt.Println(err)
+		logger.Log("error", err.Error())
+		return
+	}
+
+	// Load direct messages queued for offline users
+	if err := utilities.InitOfflineMessages(); err != nil {
+		fmt.Println(err)
+		logger.Log("error", err.Error())
+		return
+	}
+
+	// Load stored direct message conversations
+	if err := utilities.InitConversations(); err != nil {
+		fmt.Println(err)
+		logger.Log("error", err.Error())
+		return
+	}
+
 	listener, port, err := utilities.CreatePort()
 	if err != nil {
 		fmt.Println("[USAGE]: ./TCPChat $port")
@@ -23,10 +52,49 @@ func main() {
 	fmt.Printf("Server started on port " + port + "...\n")
 	logger.Log("", "Server started on port "+port)
 
-	// Start the idle timeout checker
-	utilities.StartIdleTimeoutChecker()
+	// Telnet clients get their own port so nc users never see negotiation bytes
+	telnetListener, err := utilities.CreateTelnetPort()
+	if err != nil {
+		fmt.Println("Failed to create telnet port: " + err.Error())
+		logger.Log("error", "Failed to create telnet port: "+err.Error())
+		return
+	}
+	if telnetListener != nil {
+		defer telnetListener.Close()
+		fmt.Printf("Telnet clients can connect on port " + utilities.ServerConfig.TelnetPort + "...\n")
+		logger.Log("", "Telnet listener started on port "+utilities.ServerConfig.TelnetPort)
+		go acceptClients(telnetListener, logger, utilities.HandleTelnetClient)
+	}
+
+	// Bots and scripts can use a port that speaks JSON from the start
+	jsonListener, err := utilities.CreateJSONPort()
+	if err != nil {
+		fmt.Println("Failed to create JSON port: " + err.Error())
+		logger.Log("error", "Failed to create JSON port: "+err.Error())
+		return
+	}
+	if jsonListener != nil {
+		defer jsonListener.Close()
+		fmt.Printf("JSON clients can connect on port " + utilities.ServerConfig.JSONPort + "...\n")
+		logger.Log("", "JSON listener started on port "+utilities.ServerConfig.JSONPort)
+		go acceptClients(jsonListener, logger, utilities.HandleJSONClient)
+	}
+
+	// Let integrations post into the chat over HTTP
+	if err := utilities.StartWebhookServer(); err != nil {
+		fmt.Println("Failed to start webhook server: " + err.Error())
+		logger.Log("error", "Failed to start webhook server: "+err.Error())
+		return
+	}
+
+	// Notify external systems about chat events
+	utilities.StartWebhookSender()
+
+	acceptClients(listener, logger, utilities.HandleClient)
+}
 
-	//infinite loop to accept all clients
+// acceptClients runs an infinite loop to accept all clients of a listener
+func acceptClients(listener net.Listener, logger *utilities.Logger, handle func(net.Conn)) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
@@ -34,6 +102,6 @@ func main() {
 			continue
 		}
 
-		go utilities.HandleClient(conn)
+		go handle(conn)
 	}
 }
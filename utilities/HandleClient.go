@@ -14,89 +14,210 @@ var mu sync.Mutex
 
 // UserInfo holds client information
 type UserInfo struct {
-	name       string
-	color      string
-	colorCode  string
-	joinedAt   time.Time
-	lastActive time.Time
+	name        string
+	color       string
+	colorCode   string
+	joinedAt    time.Time
+	lastActive  time.Time
+	away        bool
+	autoAway    bool // away was set by the idle checker
+	awayReason  string
+	status      string
+	room        string
+	ipAddr      string
+	operator    bool
+	bot         bool   // posted through a webhook, not connected
+	integration string // integration a webhook bot posts for, it is ignored by that name
+	account     bool   // logged in to a registered account
+	prefs       Preferences
+	ignored     map[string]string // names of the ignored users by NameKey
+
+	// Token to resume the session after a lost connection
+	resumeToken string
 }
 
 // Map to store active client connections
 var (
 	Clients = make(map[net.Conn]*UserInfo) //to keep the client/conn names dynamic we need a pointer
 
-	// Map to track remote addresses
-	remoteAddresses = make(map[string]bool)
+	// Number of connections from each remote address
+	remoteAddresses = make(map[string]int)
 
-	// Extract client IP
-	IpAddr string
+	// Number of connections opened from each IP address since the server started
+	connectionCounts = make(map[string]int)
 )
 
 const (
 	MaxUsers         = 10
 	MaxMessageLength = 200
+
+	// Room every user is placed in
+	DefaultRoom = "general"
 )
 
+// HandleClient serves a client connected to the main port
 func HandleClient(conn net.Conn) {
+	handleClient(NewClientConn(conn, false))
+}
+
+// HandleTelnetClient serves a client connected to the telnet port
+func HandleTelnetClient(conn net.Conn) {
+	handleClient(NewClientConn(conn, true))
+}
 
-	IpAddr = conn.RemoteAddr().(*net.TCPAddr).IP.String()
+func handleClient(conn *ClientConn) {
+
+	ipAddr := remoteIP(conn)
 	// Lock only while modifying shared data
 	mu.Lock()
-	if len(Clients) >= MaxUsers {
+	// Sessions waiting to be resumed do not take a place, their users are not here
+	if connectedClients() >= MaxUsers {
 		mu.Unlock()
 		conn.Write([]byte("The server is full, please try again later.\n"))
 		conn.Close()
 		return
 	}
-	if remoteAddresses[IpAddr] {
-		mu.Unlock()
-		conn.Write([]byte("You are already connected to the chat.\n"))
-		conn.Close()
-		return
-	}
-	remoteAddresses[IpAddr] = true
+	// A second connection from an address is only allowed for another session of a registered user
+	sharedAddress := remoteAddresses[ipAddr] > 0
+	remoteAddresses[ipAddr]++
+	connectionCounts[ipAddr]++
 	mu.Unlock()
 
-	// Send welcome message (No need to hold lock)
-	conn.Write([]byte(LinuxLogo))
 	chatLogger.Log("connection", "New connection from "+conn.RemoteAddr().String())
 
 	reader := bufio.NewReader(conn)
 
-	name := NameLoginFunc(conn, reader)
+	// The name is checked again when the user is added, another login may
+	// have taken it while this one chose a color, then the login starts over
+	var name string
+	var user *UserInfo
+	for user == nil {
+		var userColor, userColorCode string
+		// JSON clients send name and color in a single login request, clients on
+		// the main port switch to JSON with a handshake instead of their name
+		if conn.IsJSON() {
+			name, userColor, userColorCode = JSONLoginFunc(conn, reader)
+		} else if name = NameLoginFunc(conn, reader); conn.IsJSON() {
+			name, userColor, userColorCode = JSONLoginFunc(conn, reader)
+		}
 
-	userColor, userColorCode := ColorLoginFunc(conn, reader, name)
+		// Users who lost their connection continue their session instead
+		if name, ok := resumedName(conn); ok {
+			go handleMessages(conn, reader, name)
+			return
+		}
 
-	// Register client
-	now := time.Now()
-	mu.Lock()
-	Clients[conn] = &UserInfo{
-		name:       name,
-		color:      userColor,
-		colorCode:  userColorCode,
-		joinedAt:   now,
-		lastActive: now,
+		// Clients that closed the connection or gave too many wrong passwords never logged in
+		if name == "" {
+			mu.Lock()
+			releaseAddress(ipAddr)
+			mu.Unlock()
+			conn.Close()
+			return
+		}
+
+		// Registered users who are logged in elsewhere get another session
+		mu.Lock()
+		existing := onlineAccount(name)
+		if sharedAddress && existing == nil {
+			releaseAddress(ipAddr)
+			mu.Unlock()
+			conn.Write([]byte("You are already connected to the chat.\n"))
+			conn.Close()
+			return
+		}
+		mu.Unlock()
+		if existing != nil {
+			openSession(conn, reader, existing)
+			return
+		}
+
+		// The session a JSON client was going to join closed after its login
+		if conn.IsJSON() && userColor == "" {
+			if userColor, userColorCode = savedColor(conn, name); userColor == "" {
+				userColor, userColorCode = freeColor(conn)
+			}
+		}
+
+		if !conn.IsJSON() {
+			// Send welcome message (No need to hold lock)
+			if prefs, _ := accountPrefs(name); !prefs.HidePenguin {
+				PrintLogo(conn)
+			}
+
+			// Registered users keep their saved color while it is free
+			userColor, userColorCode = savedColor(conn, name)
+			if userColor == "" {
+				userColor, userColorCode = ColorLoginFunc(conn, reader)
+			}
+			if userColor == "" {
+				mu.Lock()
+				releaseAddress(ipAddr)
+				mu.Unlock()
+				return
+			}
+		}
+		prefs, account := accountPrefs(name)
+
+		// Register client
+		now := time.Now()
+		mu.Lock()
+		if existing := onlineAccount(name); existing != nil {
+			mu.Unlock()
+			openSession(conn, reader, existing)
+			return
+		}
+		if problem := checkName(conn, name); problem != "" {
+			mu.Unlock()
+			Notify(conn, problem+"\n")
+			continue
+		}
+		user = &UserInfo{
+			name:       name,
+			color:      userColor,
+			colorCode:  userColorCode,
+			joinedAt:   now,
+			lastActive: now,
+			room:       DefaultRoom,
+			ipAddr:     conn.RemoteAddr().(*net.TCPAddr).IP.String(),
+			account:    account,
+			prefs:      prefs,
+			ignored:    ignoreSet(accountIgnored(name)),
+		}
+		if ServerConfig.ResumeGrace.Duration > 0 {
+			user.resumeToken = newResumeToken()
+		}
+		Clients[conn] = user
+		scheduleIdleCheck(conn, user)
+		mu.Unlock()
+		applyPreferences(conn, user.prefs)
 	}
-	mu.Unlock()
 
-	chatLogger.Log("connection", "User "+name+" "+IpAddr+" joined the chat")
+	chatLogger.Log("connection", "User "+name+" "+ipAddr+" joined the chat")
+	MarkKnownUser(name)
 
 	// Send chat history and welcome message
 	SendMessageHistory(conn)
-	PrintWelcomeMessage(conn)
+	sendWelcome(conn, user)
+
+	// Deliver direct messages received while offline
+	DeliverOfflineMessages(conn, name)
 
 	// Notify others about the new user
 	joinMsg := FormatJoinMessage(name)
 	mu.Lock()
-	messageHistory = append(messageHistory, joinMsg)
+	AddToHistory(joinMsg)
 	mu.Unlock()
 
 	// Broadcast to other users
+	joinEvent := userEvent(EventJoin, user)
+	PublishEvent(joinEvent)
 	go func() {
 		mu.Lock()
 		for client := range Clients {
-			if client != conn { // Send to everyone except the new user
-				client.Write([]byte(userColor + joinMsg + Reset))
+			// Send to everyone except the new user and those who hide joins
+			if client != conn && !Clients[client].prefs.HideJoins {
+				SendEvent(client, joinEvent, user.color+stamp(client, joinEvent.Time)+joinMsg+Reset)
 			}
 		}
 		mu.Unlock()
@@ -106,8 +227,22 @@ func HandleClient(conn net.Conn) {
 	go handleMessages(conn, reader, name)
 }
 
-// BroadCast sends a message to all connected clients
-func BroadCast(conn net.Conn, msg string, exit bool) {
+// sendWelcome greets a user who logged in, JSON clients get a welcome event
+func sendWelcome(conn *ClientConn, user *UserInfo) {
+	if conn.IsJSON() {
+		ev := userEvent(EventWelcome, user)
+		ev.Token = user.resumeToken
+		conn.WriteEvent(ev)
+		return
+	}
+	PrintWelcomeMessage(conn)
+	if user.resumeToken != "" {
+		conn.Write([]byte(resumeNotice(user.resumeToken)))
+	}
+}
+
+// BroadCast sends a message to all connected clients, JSON clients get the event instead
+func BroadCast(conn net.Conn, msg string, ev Event) {
 	mu.Lock()
 	defer mu.Unlock()
 
@@ -115,18 +250,47 @@ func BroadCast(conn net.Conn, msg string, exit bool) {
 	if !exists {
 		senderInfo = &UserInfo{name: "Unknown", color: Reset} // Fallback if sender is gone
 	}
+	broadcastFrom(senderInfo, msg, ev)
+}
+
+// BroadCastBot sends a message from a bot that has no connection to all connected clients
+func BroadCastBot(bot *UserInfo, msg string, ev Event) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	broadcastFrom(bot, msg, ev)
+}
+
+// broadcastFrom logs, stores and delivers a message, mu must be held
+func broadcastFrom(senderInfo *UserInfo, msg string, ev Event) {
+	exit := ev.Type == EventLeave
 
 	// Only log chat messages, not exit messages
 	if !exit {
 		chatLogger.Log("chat", strings.TrimSpace(msg))
 	}
 
-	// Add to message history
-	AddToHistory(msg)
+	// Add to message history, chat messages keep their markup there and get it
+	// rendered for every client
+	text := msg
+	if ev.Type == EventMessage {
+		addHistoryEntry(msg, senderInfo.ignoreName(), ev.Text)
+		text = withMarkup(msg, ev.Text, MarkupToANSI, plainText)
+	} else {
+		AddToHistory(msg)
+	}
 
-	for client := range Clients {
-		client.Write([]byte(senderInfo.color + msg + Reset))
+	for client, info := range Clients {
+		if exit && info.prefs.HideJoins {
+			continue
+		}
+		if ev.Type == EventMessage && info.ignores(senderInfo.ignoreName()) {
+			continue
+		}
+		SendEvent(client, ev, senderInfo.color+stamp(client, ev.Time)+text+Reset)
 	}
+
+	PublishEvent(ev)
 }
 
 // handleMessages processes incoming messages from a client
@@ -135,55 +299,59 @@ func handleMessages(conn net.Conn, reader *bufio.Reader, name string) {
 		for {
 			msg, err := reader.ReadString('\n')
 			if err != nil {
+				// Keep the session for a while so the user can resume it
+				if Suspend(conn) {
+					return
+				}
 				Logout(conn, name)
-				chatLogger.Log("connection", "User "+name+" "+IpAddr+" disconnected")
+				chatLogger.Log("connection", "User "+name+" "+remoteIP(conn)+" disconnected")
 				return
 			}
 
 			// Update last active timestamp
 			UpdateLastActive(conn)
 
-			// Check if this connection is in warning response mode
-			warningMu.Lock()
-			inWarning := inWarningResponse[conn]
-			warningMu.Unlock()
-
-			if inWarning {
-				// Reset warning status
-				warnedUsersMu.Lock()
-				delete(warnedUsers, conn)
-				warnedUsersMu.Unlock()
+			// JSON clients send requests instead of text, every request answers
+			// an idle warning and is handled as usual
+			if c, ok := conn.(*ClientConn); ok && c.IsJSON() {
+				clearIdleWarning(conn)
+				handleJSONRequest(c, msg)
+				continue
+			}
 
-				// Confirm they're staying connected
+			// The first line after an idle warning only confirms the user is still there
+			if clearIdleWarning(conn) {
 				conn.Write([]byte("\033[32mYou will remain connected.\033[0m\n"))
+				continue
+			}
 
-				// Remove from warning response mode
-				warningMu.Lock()
-				delete(inWarningResponse, conn)
-				warningMu.Unlock()
-
+			// The first line after the color menu is the user's choice
+			if answerColorMenu(conn, msg) {
 				continue
 			}
 
 			// Normal message processing
-			msg = strings.TrimSpace(msg)
+			msg = strings.TrimSpace(SanitizeInput(msg))
 
 			// Skip empty messages
 			if msg == "" {
-				conn.Write([]byte("\033[1A\033[2K"))
+				ClearInputLine(conn)
 				continue
 			}
 
 			name, message := Flags(conn, msg)
 			if message != "" {
 				if len(message) > MaxMessageLength {
-					conn.Write([]byte("\033[A\033[2K"))
+					ClearInputLine(conn)
 					conn.Write([]byte(FormatErrorMessage("Error: Message too long. Maximum length is "+fmt.Sprint(MaxMessageLength)+" characters.") + "\n"))
 					continue
 				}
 
-				conn.Write([]byte("\033[A\033[2K"))
-				BroadCast(conn, FormatChatMessage(name, message), false)
+				ClearInputLine(conn)
+				mu.Lock()
+				ev := chatEvent(Clients[conn], message)
+				mu.Unlock()
+				BroadCast(conn, FormatChatMessage(name, message), ev)
 			}
 		}
 	}()
@@ -0,0 +1,273 @@
+package utilities
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+)
+
+const (
+	// File used to keep registered accounts and their preferences
+	AccountStoreFile = "accounts.json"
+
+	// Shortest password accepted by /register
+	MinPasswordLength = 6
+
+	// Number of wrong passwords before the address is locked out and disconnected
+	MaxPasswordAttempts = 3
+
+	// PBKDF2 rounds used to hash passwords
+	passwordIterations = 100000
+)
+
+// Account is a registered username with its password hash and preferences
+type Account struct {
+	Name  string      `json:"name"`
+	Salt  string      `json:"salt"`
+	Hash  string      `json:"hash"`
+	Prefs Preferences `json:"prefs"`
+
+	// Users whose messages the account's user does not see
+	Ignored []string `json:"ignored,omitempty"`
+}
+
+var (
+	// Mutex for protecting the accounts
+	accountsMu sync.Mutex
+
+	// Registered accounts by NameKey
+	accounts = make(map[string]*Account)
+)
+
+// InitAccounts loads the registered accounts from disk
+func InitAccounts() error {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+
+	data, err := os.ReadFile(AccountStoreFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading accounts: %v", err)
+	}
+
+	var stored []*Account
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return fmt.Errorf("error parsing accounts: %v", err)
+	}
+	for _, account := range stored {
+		accounts[NameKey(account.Name)] = account
+	}
+	return nil
+}
+
+// saveAccounts writes all accounts to disk, accountsMu must be held
+func saveAccounts() {
+	stored := make([]*Account, 0, len(accounts))
+	for _, account := range accounts {
+		stored = append(stored, account)
+	}
+
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		chatLogger.Log("error", "Failed to encode accounts: "+err.Error())
+		return
+	}
+	if err := os.WriteFile(AccountStoreFile, data, 0600); err != nil {
+		chatLogger.Log("error", "Failed to save accounts: "+err.Error())
+	}
+}
+
+// IsRegistered reports whether a name belongs to an account
+func IsRegistered(name string) bool {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+
+	return accounts[NameKey(name)] != nil
+}
+
+// accountPrefs returns a copy of the preferences of an account
+func accountPrefs(name string) (Preferences, bool) {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+
+	account := accounts[NameKey(name)]
+	if account == nil {
+		return Preferences{}, false
+	}
+	return account.Prefs, true
+}
+
+// saveAccountPrefs stores the preferences of an account, names without an account are ignored
+func saveAccountPrefs(name string, prefs Preferences) {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+
+	if account := accounts[NameKey(name)]; account != nil {
+		account.Prefs = prefs
+		saveAccounts()
+	}
+}
+
+// accountIgnored returns the ignore list of an account
+func accountIgnored(name string) []string {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+
+	if account := accounts[NameKey(name)]; account != nil {
+		return append([]string(nil), account.Ignored...)
+	}
+	return nil
+}
+
+// accountIgnores reports whether the account of name ignores messages from sender
+func accountIgnores(name, sender string) bool {
+	for _, ignored := range accountIgnored(name) {
+		if sameName(ignored, sender) {
+			return true
+		}
+	}
+	return false
+}
+
+// saveAccountIgnored stores the ignore list of an account, only registered
+// users and integrations are kept in it since a guest name may belong to
+// someone else later
+func saveAccountIgnored(name string, ignored []string) {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+
+	account := accounts[NameKey(name)]
+	if account == nil {
+		return
+	}
+	account.Ignored = nil
+	for _, ignoredName := range ignored {
+		if accounts[NameKey(ignoredName)] != nil || integrationNamed(ignoredName) != nil {
+			account.Ignored = append(account.Ignored, ignoredName)
+		}
+	}
+	saveAccounts()
+}
+
+// renameAccount moves an account to a new name when its user renames, the
+// ignore lists of other accounts follow the rename
+func renameAccount(oldName, newName string) {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+
+	account := accounts[NameKey(oldName)]
+	if account == nil {
+		return
+	}
+	delete(accounts, NameKey(oldName))
+	account.Name = newName
+	accounts[NameKey(newName)] = account
+	for _, other := range accounts {
+		for i, ignored := range other.Ignored {
+			if sameName(ignored, oldName) {
+				other.Ignored[i] = newName
+			}
+		}
+	}
+	saveAccounts()
+}
+
+// checkPassword reports whether the password belongs to the account of the name
+func checkPassword(name, password string) bool {
+	accountsMu.Lock()
+	account := accounts[NameKey(name)]
+	accountsMu.Unlock()
+	if account == nil {
+		return false
+	}
+
+	salt, err := hex.DecodeString(account.Salt)
+	if err != nil {
+		return false
+	}
+	hash := hex.EncodeToString(hashPassword(password, salt))
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(account.Hash)) == 1
+}
+
+// Register creates an account for the user's current name, their current
+// preferences and ignore list become the account's
+func Register(conn net.Conn, password string) {
+	mu.Lock()
+	client, exists := Clients[conn]
+	if !exists {
+		mu.Unlock()
+		return
+	}
+	name := client.name
+	prefs := client.prefs
+	ignored := client.ignoredNames()
+	mu.Unlock()
+
+	if len(password) < MinPasswordLength {
+		conn.Write([]byte(FormatErrorMessage(fmt.Sprintf("\nError: The password must be at least %d characters long.", MinPasswordLength)) + "\n"))
+		return
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		conn.Write([]byte(FormatErrorMessage("\nError: Could not create the account.") + "\n"))
+		return
+	}
+
+	accountsMu.Lock()
+	if accounts[NameKey(name)] != nil {
+		accountsMu.Unlock()
+		conn.Write([]byte(FormatErrorMessage("\nError: "+name+" is already registered.") + "\n"))
+		return
+	}
+	account := &Account{
+		Name:  name,
+		Salt:  hex.EncodeToString(salt),
+		Hash:  hex.EncodeToString(hashPassword(password, salt)),
+		Prefs: prefs,
+	}
+	for _, ignoredName := range ignored {
+		if accounts[NameKey(ignoredName)] != nil || integrationNamed(ignoredName) != nil {
+			account.Ignored = append(account.Ignored, ignoredName)
+		}
+	}
+	accounts[NameKey(name)] = account
+	saveAccounts()
+	accountsMu.Unlock()
+
+	mu.Lock()
+	client.account = true
+	mu.Unlock()
+
+	chatLogger.Log("connection", "User "+name+" registered")
+	conn.Write([]byte("The name " + name + " is now registered. Use your password the next time you log in.\n"))
+}
+
+// hashPassword derives a key from a password with PBKDF2-HMAC-SHA256
+func hashPassword(password string, salt []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write(salt)
+	mac.Write(binary.BigEndian.AppendUint32(nil, 1))
+	u := mac.Sum(nil)
+
+	key := append([]byte(nil), u...)
+	for i := 1; i < passwordIterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
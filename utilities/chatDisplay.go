@@ -4,7 +4,8 @@ import (
 	"fmt"
 	"net"
 	"strings"
-	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // ANSI color codes for terminal output
@@ -48,60 +49,123 @@ const (
                     '-'       '--'
 `
 
-	ColorMenu = `╔════════════════════════════════════════════════════════╗
-║  Choose your color:                                    ║
-║  ` + Red + "1. Red" + Reset + `                                                ║
-║  ` + Green + "2. Green" + Reset + `                                              ║
-║  ` + Yellow + "3. Yellow" + Reset + `                                             ║
-║  ` + Blue + "4. Blue" + Reset + `                                               ║
-║  ` + Pink + "5. Pink" + Reset + `                                               ║
-║  ` + Cyan + "6. Cyan" + Reset + `                                               ║
-║  ` + Purple + "7. Purple" + Reset + `                                             ║
-║  ` + Orange + "8. Orange" + Reset + `                                             ║
-║  ` + Teal + "9. Teal" + Reset + `                                               ║
-║  ` + Lime + "10. Lime" + Reset + `                                              ║
-╚════════════════════════════════════════════════════════╝
-Enter number (1-10): `
+	// Versions without the box for terminals narrower than the menus
+	CompactLogo = Yellow + "Welcome to TCP-Chat!" + Reset + "\n"
 )
 
-func PrintUsage(flag string) string {
+// Width of the boxes drawn around menus and notices
+const (
+	boxWidth  = 58
+	logoWidth = 44
+)
+
+// narrowTerminal reports whether the client told us its terminal is narrower than width
+func narrowTerminal(conn net.Conn, width int) bool {
+	termWidth := terminalWidth(conn)
+	return termWidth > 0 && termWidth < width
+}
+
+// PrintLogo sends the welcome penguin, or a one line greeting on narrow terminals
+func PrintLogo(conn net.Conn) {
+	if c, ok := conn.(*ClientConn); ok && c.IsJSON() {
+		return
+	}
+	if narrowTerminal(conn, logoWidth) {
+		conn.Write([]byte(CompactLogo))
+		return
+	}
+	conn.Write([]byte(LinuxLogo))
+}
+
+// PrintColorMenu sends a menu of the given colors that fits the client's terminal
+func PrintColorMenu(conn net.Conn, colors []PaletteColor) {
+	prompt := fmt.Sprintf("Enter number (1-%d) or press Enter for a free color: ", len(colors))
+	if len(colors) == 0 {
+		prompt = "All colors are taken, press Enter for a new one or type #rrggbb: "
+	}
+
+	if narrowTerminal(conn, boxWidth) {
+		menu := "Choose your color:\n"
+		for i, color := range colors {
+			entry := fmt.Sprintf("%d. %s", i+1, colorLabel(color.Name))
+			menu += color.escape + entry + Reset
+			if i%2 == 0 && i < len(colors)-1 {
+				menu += strings.Repeat(" ", max(12-len(entry), 1))
+			} else {
+				menu += "\n"
+			}
+		}
+		conn.Write([]byte(menu + prompt))
+		return
+	}
+
+	menu := "╔" + strings.Repeat("═", boxWidth-2) + "╗\n" + boxLine("", "Choose your color:")
+	for i, color := range colors {
+		menu += boxLine(color.escape, fmt.Sprintf("%d. %s", i+1, colorLabel(color.Name)))
+	}
+	menu += "╚" + strings.Repeat("═", boxWidth-2) + "╝\n"
+	conn.Write([]byte(menu + prompt))
+}
+
+// boxLine returns one line of a boxed menu, the text is shown in the given color
+func boxLine(color, text string) string {
+	padding := max(boxWidth-4-utf8.RuneCountInString(text), 1)
+	if color != "" {
+		text = color + text + Reset
+	}
+	return "║  " + text + strings.Repeat(" ", padding) + "║\n"
+}
+
+// colorLabel returns a color name the way menus show it, like Red
+func colorLabel(name string) string {
+	r, size := utf8.DecodeRuneInString(name)
+	return string(unicode.ToUpper(r)) + name[size:]
+}
+
+// PrintUsage returns the help for one command, or for every command the user may run when cmd is nil
+func PrintUsage(user *UserInfo, cmd *Command) string {
 	start := "\nUSAGE:\n"
-	help := "* Help usage: -h or --help\n"
-	rename := "* Change your name usage: -r or --rename <new name>\n"
-	quit := "* Logout usage: -q or --quit\n\n"
-	dm := "* For private message usage: -dm <reciever> <private message>\n"
-	color := "* Change your color: -c or --color\n"
-	users := "* List online users: -u or --users\n"
-
-	switch flag {
-	case "-h", "--help":
-		return start + help
-	case "-r", "--rename":
-		return start + rename
-	case "-c", "--color":
-		return start + color
-	case "-u", "--users":
-		return start + users
-	case "-dm":
-		return start + dm
-	case "-q", "--quit":
-		return start + quit
-	default:
-		return start + help + rename + color + users + dm + quit
+	if cmd != nil {
+		return start + cmd.usage()
 	}
+
+	commandsMu.RLock()
+	defer commandsMu.RUnlock()
+
+	usage := start
+	for _, cmd := range commands {
+		if user == nil || cmd.allowed(user) {
+			usage += cmd.usage()
+		}
+	}
+	return usage + "\n"
 }
 
 func PrintWelcomeMessage(conn net.Conn) {
+	if narrowTerminal(conn, boxWidth) {
+		conn.Write([]byte("\n\033[32mYou can start chatting now.\nUse /help to see available commands.\033[0m\n\n"))
+		return
+	}
 
 	welcomeMsg := fmt.Sprintf("\n\033[32m╔════════════════════════════════════════════════════════╗\n" +
 		"║  You can start chatting now.                           ║\n" +
-		"║  Use -h or --help to see available commands.           ║\n" +
+		"║  Use /help to see available commands.                  ║\n" +
 		"╚════════════════════════════════════════════════════════╝\033[0m\n\n")
 
 	conn.Write([]byte(welcomeMsg))
 }
 
 func PrintWarningMessage(conn net.Conn) {
+	// Sent from the idle timer, so JSON clients get it as a notice
+	if c, ok := conn.(*ClientConn); ok && c.IsJSON() {
+		Notify(conn, "WARNING: You will be disconnected due to inactivity, send any request to remain connected.")
+		return
+	}
+	if narrowTerminal(conn, boxWidth) {
+		conn.Write([]byte("\n\033[33mWARNING: You will be disconnected due to inactivity.\nType anything and press Enter to remain connected.\033[0m\n> "))
+		return
+	}
+
 	// Send warning message with a prompt for input
 	warningMsg := "\n\033[33m╔════════════════════════════════════════════════════════╗\n" +
 		"║  WARNING: You will be disconnected due to inactivity.  ║\n" +
@@ -110,39 +174,42 @@ func PrintWarningMessage(conn net.Conn) {
 	conn.Write([]byte(warningMsg))
 }
 
-// Message formatting functions
+// Message formatting functions, they leave out the timestamp because every
+// client gets it in its own timezone, see stamp
 // FormatJoinMessage creates a formatted string when a user joins
 func FormatJoinMessage(name string) string {
-	return fmt.Sprintf("[%s] %s joined the chat\n",
-		time.Now().Format("2006-01-02 15:04:05"),
-		name)
+	return fmt.Sprintf(" %s joined the chat\n", name)
 }
 
 // FormatExitMessage creates a formatted string when a user leaves
 func FormatExitMessage(name string) string {
-	return fmt.Sprintf("[%s] %s left the chat\n",
-		time.Now().Format("2006-01-02 15:04:05"),
-		name)
+	return fmt.Sprintf(" %s left the chat\n", name)
 }
 
 // FormatChatMessage creates a formatted string for regular chat messages
 func FormatChatMessage(name, msg string) string {
-	return fmt.Sprintf("[%s][%s] %s\n",
-		time.Now().Format("2006-01-02 15:04:05"),
-		name,
-		msg)
+	return fmt.Sprintf("[%s] %s\n", name, msg)
 }
 
-// FormatPrivateMessage creates a formatted string for private messages
-func FormatPrivateMessage(sender, receiver, msg string, isSender bool) string {
+// FormatBotMessage creates a formatted string for messages posted by bots
+func FormatBotMessage(name, msg string) string {
+	return fmt.Sprintf("[BOT %s] %s\n", name, msg)
+}
+
+// FormatPrivateMessage creates a formatted string for private messages,
+// receivers holds every recipient so group messages show the whole group
+func FormatPrivateMessage(sender string, receivers []string, msg string, isSender bool) string {
 	if isSender {
-		return fmt.Sprintf("[%s][DM to %s]: %s\n",
-			time.Now().Format("2006-01-02 15:04:05"),
-			receiver,
+		return fmt.Sprintf("[DM to %s]: %s\n",
+			strings.Join(receivers, ", "),
+			msg)
+	} else if len(receivers) > 1 {
+		return fmt.Sprintf("[Group DM from %s to %s]: %s\n",
+			sender,
+			strings.Join(receivers, ", "),
 			msg)
 	} else {
-		return fmt.Sprintf("[%s][DM from %s]: %s\n",
-			time.Now().Format("2006-01-02 15:04:05"),
+		return fmt.Sprintf("[DM from %s]: %s\n",
 			sender,
 			msg)
 	}
@@ -150,8 +217,7 @@ func FormatPrivateMessage(sender, receiver, msg string, isSender bool) string {
 
 // FormatSystemMessage formats a system message
 func FormatSystemMessage(message string) string {
-	timestamp := time.Now().Format("2006-01-02 15:04:05")
-	return fmt.Sprintf("[%s] %s", timestamp, message)
+	return " " + message
 }
 
 // FormatErrorMessage formats an error message with red and bold styling for the "Error" word
@@ -166,31 +232,3 @@ func FormatErrorMessage(message string) string {
 	}
 	return message
 }
-
-// GetColorByChoice returns the ANSI color code based on user selection
-func GetColorByChoice(choice string) (string, string) {
-	switch choice {
-	case "1":
-		return Red, choice
-	case "2":
-		return Green, choice
-	case "3":
-		return Yellow, choice
-	case "4":
-		return Blue, choice
-	case "5":
-		return Pink, choice
-	case "6":
-		return Cyan, choice
-	case "7":
-		return Purple, choice
-	case "8":
-		return Orange, choice
-	case "9":
-		return Teal, choice
-	case "10":
-		return Lime, choice
-	default:
-		return "", ""
-	}
-}
@@ -0,0 +1,141 @@
+package utilities
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Permission is the level a user needs to run a command
+type Permission int
+
+const (
+	PermUser Permission = iota
+	PermOperator
+)
+
+const (
+	// Unlimited is used as MaxArgs by commands that take any number of arguments
+	Unlimited = -1
+
+	// CommandPrefix starts a command, typing it twice sends a literal line
+	CommandPrefix = "/"
+)
+
+// Command is a chat command, its name and aliases are written without the prefix
+type Command struct {
+	Name       string
+	Aliases    []string
+	Args       string // argument spec shown in the usage, like "<user> <message>"
+	MinArgs    int
+	MaxArgs    int // Unlimited when the last argument is free text
+	Permission Permission
+	Help       string
+	Run        func(conn net.Conn, args []string)
+}
+
+var (
+	// Mutex for the command registry
+	commandsMu sync.RWMutex
+
+	// Registered commands in the order they are shown in the help
+	commands []*Command
+
+	// Commands by name and alias
+	commandLookup = make(map[string]*Command)
+)
+
+// RegisterCommand adds a command, it fails if the name or an alias is already taken
+func RegisterCommand(cmd *Command) error {
+	if cmd.Name == "" || cmd.Run == nil {
+		return fmt.Errorf("a command needs a name and a run function")
+	}
+	if cmd.MaxArgs != Unlimited && cmd.MaxArgs < cmd.MinArgs {
+		return fmt.Errorf("command %s allows fewer arguments than it requires", cmd.Name)
+	}
+
+	commandsMu.Lock()
+	defer commandsMu.Unlock()
+
+	names := append([]string{cmd.Name}, cmd.Aliases...)
+	for _, name := range names {
+		if strings.HasPrefix(name, "-") || strings.HasPrefix(name, CommandPrefix) || strings.ContainsAny(name, " \t") {
+			return fmt.Errorf("invalid command name %q", name)
+		}
+		if commandLookup[name] != nil {
+			return fmt.Errorf("command %s is already registered", name)
+		}
+	}
+	for _, name := range names {
+		commandLookup[name] = cmd
+	}
+	commands = append(commands, cmd)
+	return nil
+}
+
+// mustRegisterCommand registers a built-in command and panics on a conflict
+func mustRegisterCommand(cmd *Command) {
+	if err := RegisterCommand(cmd); err != nil {
+		panic(err)
+	}
+}
+
+// findCommand returns the command with the given name or alias, nil if there is none
+func findCommand(name string) *Command {
+	commandsMu.RLock()
+	defer commandsMu.RUnlock()
+
+	return commandLookup[name]
+}
+
+// spellings returns how a command is typed, the name first and then its aliases
+func (cmd *Command) spellings() []string {
+	spellings := []string{CommandPrefix + cmd.Name}
+	for _, alias := range cmd.Aliases {
+		spellings = append(spellings, CommandPrefix+alias)
+	}
+	return spellings
+}
+
+// usage returns the help line of a command
+func (cmd *Command) usage() string {
+	line := "* " + cmd.Help + ": " + strings.Join(cmd.spellings(), " or ")
+	if cmd.Args != "" {
+		line += " " + cmd.Args
+	}
+	return line + "\n"
+}
+
+// can reports whether a user has a permission level, it is used for whole
+// commands and for the parts of a command only some users may see
+func (u *UserInfo) can(perm Permission) bool {
+	return perm == PermUser || perm == PermOperator && u.operator
+}
+
+// allowed reports whether a user may run a command
+func (cmd *Command) allowed(user *UserInfo) bool {
+	return user.can(cmd.Permission)
+}
+
+// acceptsArgs reports whether a command can run with the given number of arguments
+func (cmd *Command) acceptsArgs(n int) bool {
+	return n >= cmd.MinArgs && (cmd.MaxArgs == Unlimited || n <= cmd.MaxArgs)
+}
+
+// runCommand checks permission and arguments and runs a command
+func runCommand(conn net.Conn, user *UserInfo, cmd *Command, message string, args []string) {
+	ClearInputLine(conn)
+
+	if !cmd.allowed(user) {
+		conn.Write([]byte(FormatErrorMessage("\nError: You must be an operator to use "+cmd.spellings()[0]+".") + "\n"))
+		return
+	}
+	if !cmd.acceptsArgs(len(args)) {
+		errorMsg := FormatErrorMessage("\nError - Wrong command: " + user.color + message + Reset)
+		conn.Write([]byte(errorMsg + "\n"))
+		conn.Write([]byte(PrintUsage(user, cmd)))
+		return
+	}
+	cmd.Run(conn, args)
+}
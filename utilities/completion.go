@@ -0,0 +1,115 @@
+package utilities
+
+import (
+	"net"
+	"sort"
+	"strings"
+)
+
+// completionWords is what Tab can complete, it is collected before the line
+// editor is locked because reading Clients while holding the editor could deadlock
+type completionWords struct {
+	commands []string // command names with their prefix, like /dm
+	names    []string // usernames of the other online users
+}
+
+// completion remembers the candidates repeated Tab presses cycle through
+type completion struct {
+	candidates []string
+	index      int
+	start      int // position in the line where the completed word starts
+	length     int // runes inserted by the last Tab
+}
+
+// collectCompletionWords returns the commands and usernames a client can complete
+func collectCompletionWords(conn net.Conn) completionWords {
+	var words completionWords
+
+	mu.Lock()
+	user := Clients[conn]
+	for _, info := range Clients {
+		if info != user {
+			words.names = append(words.names, info.name)
+		}
+	}
+	mu.Unlock()
+
+	commandsMu.RLock()
+	for _, cmd := range commands {
+		if user != nil && !cmd.allowed(user) {
+			continue
+		}
+		// The dash style is only kept for old clients, so it is never suggested
+		words.commands = append(words.commands, CommandPrefix+cmd.Name)
+	}
+	commandsMu.RUnlock()
+
+	sort.Strings(words.names)
+	sort.Strings(words.commands)
+	return words
+}
+
+// completeWord completes the word before the cursor, a repeated Tab replaces it
+// with the next candidate. The first word completes commands, all others usernames.
+func (e *lineEditor) completeWord() string {
+	if c := e.completion; c != nil {
+		c.index = (c.index + 1) % len(c.candidates)
+		e.replaceWord(c.start, c.start+c.length, c.candidates[c.index])
+		c.length = len([]rune(c.candidates[c.index]))
+		return e.redraw()
+	}
+
+	// Names in a group message are separated by commas
+	start := e.cursor
+	for start > 0 && e.buf[start-1] != ' ' && e.buf[start-1] != ',' {
+		start--
+	}
+	word := string(e.buf[start:e.cursor])
+
+	pool := e.words.names
+	dashes := "" // typed instead of the command prefix, kept in the completion
+	switch {
+	case start == 0 && strings.HasPrefix(word, CommandPrefix):
+		pool = e.words.commands
+	case start == 0 && ServerConfig.DashCommands && strings.HasPrefix(word, "-"):
+		// Old style commands complete like their / spelling
+		pool = e.words.commands
+		dashes = "-"
+		if strings.HasPrefix(word, "--") {
+			dashes = "--"
+		}
+		word = CommandPrefix + strings.TrimPrefix(word, dashes)
+	}
+
+	// Words are matched the way names are compared, in any letter case
+	var candidates []string
+	for _, candidate := range pool {
+		if strings.HasPrefix(NameKey(candidate), NameKey(word)) {
+			if dashes != "" {
+				candidate = dashes + strings.TrimPrefix(candidate, CommandPrefix)
+			}
+			candidates = append(candidates, candidate)
+		}
+	}
+	if len(candidates) == 0 {
+		return "\a"
+	}
+
+	// A single match is finished with a space, several are cycled through
+	text := candidates[0]
+	if len(candidates) == 1 {
+		text += " "
+	} else {
+		e.completion = &completion{candidates: candidates, start: start, length: len([]rune(text))}
+	}
+	e.replaceWord(start, e.cursor, text)
+	return e.redraw()
+}
+
+// replaceWord replaces the runes between start and end and moves the cursor behind them
+func (e *lineEditor) replaceWord(start, end int, text string) {
+	line := append([]rune{}, e.buf[:start]...)
+	line = append(line, []rune(text)...)
+	e.cursor = len(line)
+	e.buf = append(line, e.buf[end:]...)
+}
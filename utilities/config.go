@@ -0,0 +1,138 @@
+package utilities
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// File the server configuration is read from, it is optional
+const ConfigFile = "config.json"
+
+// Duration is a time.Duration written as a string like "5m" in the config file
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON parses a duration string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"5m\": %v", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+// Config holds the settings that can be changed in the config file
+type Config struct {
+	// Idle time after which a user is marked away automatically, deprecated in
+	// favour of idle.user.away_after and nil when the config file does not set it
+	AutoAwayAfter *Duration `json:"auto_away_after"`
+
+	// Idle handling of each role: user, operator and bot
+	Idle map[string]IdlePolicy `json:"idle"`
+
+	// Password for the /oper command, operators are disabled when it is empty
+	OperatorPassword string `json:"operator_password"`
+
+	// Also accept the old -h and --help style commands next to /help, off by
+	// default so messages starting with a dash are sent as typed
+	DashCommands bool `json:"dash_commands"`
+
+	// Colors users can pick, the ten default colors are used when it is empty
+	Palette []PaletteColor `json:"palette"`
+
+	// Text formatting users may send, like bold or color, all escape codes are removed when empty
+	AllowedFormatting []string `json:"allowed_formatting"`
+
+	// Port for telnet clients, the telnet listener is disabled when it is empty
+	TelnetPort string `json:"telnet_port"`
+
+	// Port for clients using the JSON protocol, disabled when it is empty
+	JSONPort string `json:"json_port"`
+
+	// Port of the HTTP server for incoming webhooks, disabled when it is empty
+	WebhookPort string `json:"webhook_port"`
+
+	// External systems allowed to post through incoming webhooks
+	Integrations []Integration `json:"integrations"`
+
+	// External URLs notified about chat events
+	OutgoingWebhooks []OutgoingWebhook `json:"outgoing_webhooks"`
+
+	// TCP keepalive probes on client connections, "0s" turns them off
+	KeepAlive Duration `json:"keepalive"`
+
+	// How often telnet and JSON clients are pinged, and how long a client that
+	// answers pings may stay silent before it is disconnected
+	PingInterval    Duration `json:"ping_interval"`
+	DeadPeerTimeout Duration `json:"dead_peer_timeout"`
+
+	// How long sending to a client may take before it is disconnected
+	WriteTimeout Duration `json:"write_timeout"`
+
+	// How long a user whose connection was lost can resume their session, "0s" turns resuming off
+	ResumeGrace Duration `json:"resume_grace"`
+
+	// How often a failed webhook delivery is retried and the delay before the first retry
+	WebhookRetries int      `json:"webhook_retries"`
+	WebhookBackoff Duration `json:"webhook_backoff"`
+}
+
+// ServerConfig is the active configuration, it holds the defaults until LoadConfig is called
+var ServerConfig = Config{
+	KeepAlive:       Duration{30 * time.Second},
+	PingInterval:    Duration{30 * time.Second},
+	DeadPeerTimeout: Duration{90 * time.Second},
+	WriteTimeout:    Duration{10 * time.Second},
+	ResumeGrace:     Duration{2 * time.Minute},
+	WebhookRetries:  5,
+	WebhookBackoff:  Duration{time.Second},
+}
+
+// LoadConfig reads the config file if there is one and checks the values
+func LoadConfig() error {
+	data, err := os.ReadFile(ConfigFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading config file: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &ServerConfig); err != nil {
+		return fmt.Errorf("error parsing config file: %v", err)
+	}
+
+	if err := checkIdlePolicies(); err != nil {
+		return err
+	}
+	if err := checkPalette(ServerConfig.Palette); err != nil {
+		return err
+	}
+	if err := checkAllowedFormatting(ServerConfig.AllowedFormatting); err != nil {
+		return err
+	}
+	if err := checkIntegrations(ServerConfig.Integrations); err != nil {
+		return err
+	}
+	if err := checkOutgoingWebhooks(ServerConfig.OutgoingWebhooks); err != nil {
+		return err
+	}
+	if err := checkKeepAlive(); err != nil {
+		return err
+	}
+	if ServerConfig.ResumeGrace.Duration < 0 {
+		return fmt.Errorf("resume_grace must not be negative")
+	}
+	if ServerConfig.WebhookRetries < 0 || ServerConfig.WebhookBackoff.Duration <= 0 {
+		return fmt.Errorf("webhook_retries must not be negative and webhook_backoff must be positive")
+	}
+	return nil
+}
@@ -0,0 +1,326 @@
+package utilities
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// File used to keep direct message conversations between server restarts
+	ConversationStoreFile = "dm_history.json"
+
+	// Maximum number of messages kept per conversation
+	MaxConversationSize = 100
+
+	// Number of messages shown by /dmhistory when no count is given
+	DefaultDMHistoryCount = 10
+)
+
+// DirectMessage is a single message inside a conversation
+type DirectMessage struct {
+	From   string    `json:"from"`
+	Color  string    `json:"color"`
+	Text   string    `json:"text"`
+	SentAt time.Time `json:"sent_at"`
+}
+
+// Conversation holds the direct messages exchanged between a set of users
+type Conversation struct {
+	Members  []string             `json:"members"`
+	Messages []DirectMessage      `json:"messages"`
+	LastRead map[string]time.Time `json:"last_read"`
+}
+
+var (
+	// Mutex for protecting the conversations map
+	conversationsMu sync.Mutex
+
+	// Conversations by their member key
+	conversations = make(map[string]*Conversation)
+)
+
+// InitConversations loads the stored direct message conversations from disk
+func InitConversations() error {
+	conversationsMu.Lock()
+	defer conversationsMu.Unlock()
+
+	data, err := os.ReadFile(ConversationStoreFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading dm history: %v", err)
+	}
+
+	var stored []*Conversation
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return fmt.Errorf("error parsing dm history: %v", err)
+	}
+
+	for _, c := range stored {
+		// Guests left when the server stopped, only conversations between accounts are kept
+		if !allRegistered(c.Members) {
+			continue
+		}
+		lastRead := make(map[string]time.Time)
+		for name, t := range c.LastRead {
+			lastRead[NameKey(name)] = t
+		}
+		c.LastRead = lastRead
+		conversations[conversationKey(c.Members)] = c
+	}
+	return nil
+}
+
+// saveConversations writes all conversations to disk, conversationsMu must be held
+func saveConversations() {
+	stored := make([]*Conversation, 0, len(conversations))
+	for _, c := range conversations {
+		stored = append(stored, c)
+	}
+
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		chatLogger.Log("error", "Failed to encode dm history: "+err.Error())
+		return
+	}
+	if err := os.WriteFile(ConversationStoreFile, data, 0666); err != nil {
+		chatLogger.Log("error", "Failed to save dm history: "+err.Error())
+	}
+}
+
+// allRegistered reports whether every member of a conversation has an account
+func allRegistered(members []string) bool {
+	for _, member := range members {
+		if !IsRegistered(member) {
+			return false
+		}
+	}
+	return true
+}
+
+// dropConversations deletes the conversations of a guest who left or renamed,
+// the file is written in the background since callers hold mu
+func dropConversations(name string) {
+	conversationsMu.Lock()
+	defer conversationsMu.Unlock()
+
+	delete(lastConversation, NameKey(name))
+	dropped := false
+	for key, c := range conversations {
+		if c.hasMember(name) {
+			delete(conversations, key)
+			dropped = true
+		}
+	}
+	if !dropped {
+		return
+	}
+	go func() {
+		conversationsMu.Lock()
+		defer conversationsMu.Unlock()
+
+		saveConversations()
+	}()
+}
+
+// conversationKey identifies a conversation by the sorted NameKeys of its members
+func conversationKey(members []string) string {
+	keys := make([]string, len(members))
+	for i, member := range members {
+		keys[i] = NameKey(member)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+// sortedMembers returns a sorted copy of the member names
+func sortedMembers(members []string) []string {
+	sorted := append([]string(nil), members...)
+	sort.Slice(sorted, func(i, j int) bool { return NameKey(sorted[i]) < NameKey(sorted[j]) })
+	return sorted
+}
+
+// RecordDirectMessage stores a direct message in the conversation between its members
+func RecordDirectMessage(members []string, msg DirectMessage) {
+	conversationsMu.Lock()
+	defer conversationsMu.Unlock()
+
+	key := conversationKey(members)
+	c, exists := conversations[key]
+	if !exists {
+		c = &Conversation{Members: sortedMembers(members), LastRead: make(map[string]time.Time)}
+		conversations[key] = c
+	}
+
+	c.Messages = append(c.Messages, msg)
+	if len(c.Messages) > MaxConversationSize {
+		c.Messages = c.Messages[len(c.Messages)-MaxConversationSize:]
+	}
+
+	// Writing into a conversation means the sender has read it
+	c.LastRead[NameKey(msg.From)] = msg.SentAt
+
+	saveConversations()
+}
+
+// visibleMessages returns the messages of the conversation whose senders are not ignored
+func (c *Conversation) visibleMessages(ignored map[string]string) []DirectMessage {
+	var msgs []DirectMessage
+	for _, msg := range c.Messages {
+		if _, skip := ignored[NameKey(msg.From)]; !skip {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+// unreadCount returns how many of the messages from others the user has not read yet
+func (c *Conversation) unreadCount(name string, msgs []DirectMessage) int {
+	count := 0
+	lastRead := c.LastRead[NameKey(name)]
+	for _, msg := range msgs {
+		if !sameName(msg.From, name) && msg.SentAt.After(lastRead) {
+			count++
+		}
+	}
+	return count
+}
+
+// ignoredBy returns the users a client ignores, their direct messages stay hidden
+func ignoredBy(conn net.Conn) map[string]string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if client, online := Clients[conn]; online {
+		return ignoreSet(client.ignoredNames())
+	}
+	return nil
+}
+
+// otherMembers returns the members of the conversation except the given user
+func (c *Conversation) otherMembers(name string) []string {
+	var others []string
+	for _, member := range c.Members {
+		if !sameName(member, name) {
+			others = append(others, member)
+		}
+	}
+	return others
+}
+
+// hasMember reports whether the user takes part in the conversation
+func (c *Conversation) hasMember(name string) bool {
+	for _, member := range c.Members {
+		if sameName(member, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// ShowInbox lists the user's conversations with their unread counts
+func ShowInbox(conn net.Conn, name string) {
+	// Messages from ignored users are neither counted nor shown as the last message
+	ignored := ignoredBy(conn)
+
+	type inboxEntry struct {
+		c    *Conversation
+		msgs []DirectMessage
+	}
+
+	conversationsMu.Lock()
+	var list []inboxEntry
+	for _, c := range conversations {
+		if !c.hasMember(name) {
+			continue
+		}
+		if msgs := c.visibleMessages(ignored); len(msgs) > 0 {
+			list = append(list, inboxEntry{c: c, msgs: msgs})
+		}
+	}
+
+	// Most recent conversations first
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].msgs[len(list[i].msgs)-1].SentAt.After(list[j].msgs[len(list[j].msgs)-1].SentAt)
+	})
+
+	inbox := "\nInbox:\n"
+	for i, entry := range list {
+		last := entry.msgs[len(entry.msgs)-1]
+		inbox += fmt.Sprintf("%d. %s (%d unread, last message %s)\n",
+			i+1, strings.Join(entry.c.otherMembers(name), ", "), entry.c.unreadCount(name, entry.msgs),
+			localTime(conn, last.SentAt))
+	}
+	conversationsMu.Unlock()
+
+	if len(list) == 0 {
+		conn.Write([]byte("Your inbox is empty\n"))
+		return
+	}
+	conn.Write([]byte(inbox + "\n"))
+}
+
+// ShowDMHistory sends the last count messages of a conversation and marks it as read
+func ShowDMHistory(conn net.Conn, name string, members []string, count int) {
+	key := conversationKey(append(append([]string(nil), members...), name))
+
+	// Messages from ignored users stay hidden
+	ignored := ignoredBy(conn)
+
+	conversationsMu.Lock()
+	c, exists := conversations[key]
+	if !exists || len(c.Messages) == 0 {
+		conversationsMu.Unlock()
+		conn.Write([]byte(FormatErrorMessage("\nError: No conversation with "+strings.Join(members, ", ")+".") + "\n"))
+		return
+	}
+
+	msgs := c.visibleMessages(ignored)
+	if len(msgs) > count {
+		msgs = msgs[len(msgs)-count:]
+	}
+
+	history := "\nConversation with " + strings.Join(c.otherMembers(name), ", ") + ":\n"
+	for _, msg := range msgs {
+		receivers := c.otherMembers(msg.From)
+		history += msg.Color + stamp(conn, msg.SentAt) + FormatPrivateMessage(msg.From, receivers, msg.Text, sameName(msg.From, name)) + Reset
+	}
+
+	c.LastRead[NameKey(name)] = c.Messages[len(c.Messages)-1].SentAt
+	saveConversations()
+	conversationsMu.Unlock()
+
+	conn.Write([]byte(history + "\n"))
+}
+
+// Last conversation each user took part in by NameKey, used by /reply
+var lastConversation = make(map[string][]string)
+
+// SetLastConversation remembers the members of the conversation a user was last active in
+func SetLastConversation(name string, members []string) {
+	conversationsMu.Lock()
+	defer conversationsMu.Unlock()
+
+	lastConversation[NameKey(name)] = sortedMembers(members)
+}
+
+// LastConversationWith returns the other members of the user's last conversation
+func LastConversationWith(name string) []string {
+	conversationsMu.Lock()
+	defer conversationsMu.Unlock()
+
+	var others []string
+	for _, member := range lastConversation[NameKey(name)] {
+		if !sameName(member, name) {
+			others = append(others, member)
+		}
+	}
+	return others
+}
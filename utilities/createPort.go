@@ -27,3 +27,19 @@ func CreatePort() (net.Listener, string, error) {
 
 	return listener, port, nil
 }
+
+// CreateTelnetPort opens the telnet listener when a telnet port is configured
+func CreateTelnetPort() (net.Listener, error) {
+	if ServerConfig.TelnetPort == "" {
+		return nil, nil
+	}
+	return net.Listen("tcp", "0.0.0.0:"+ServerConfig.TelnetPort)
+}
+
+// CreateJSONPort opens the listener for JSON clients when a JSON port is configured
+func CreateJSONPort() (net.Listener, error) {
+	if ServerConfig.JSONPort == "" {
+		return nil, nil
+	}
+	return net.Listen("tcp", "0.0.0.0:"+ServerConfig.JSONPort)
+}
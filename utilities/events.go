@@ -0,0 +1,114 @@
+package utilities
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Event types sent to clients using the JSON protocol
+const (
+	EventMessage  = "message"
+	EventJoin     = "join"
+	EventLeave    = "leave"
+	EventRename   = "rename"
+	EventColor    = "color"
+	EventDM       = "dm"
+	EventHistory  = "history"
+	EventSystem   = "system"
+	EventError    = "error"
+	EventWelcome  = "welcome"
+	EventResponse = "response"
+	EventPing     = "ping" // answered with a pong request
+)
+
+// Event is something that happened in the chat, JSON clients receive it as one
+// object per line while terminal clients get the formatted text instead
+type Event struct {
+	ID       uint64    `json:"id"`
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Room     string    `json:"room,omitempty"`
+	From     string    `json:"from,omitempty"`
+	To       []string  `json:"to,omitempty"`
+	Name     string    `json:"name,omitempty"`
+	NewName  string    `json:"new_name,omitempty"`
+	Color    string    `json:"color,omitempty"`
+	Text     string    `json:"text,omitempty"`
+	HTML     string    `json:"html,omitempty"`
+	Bot      bool      `json:"bot,omitempty"`
+	Mentions []string  `json:"mentions,omitempty"`
+	ReplyTo  string    `json:"reply_to,omitempty"`
+	OK       *bool     `json:"ok,omitempty"`
+	Lines    []string  `json:"lines,omitempty"`
+	Token    string    `json:"token,omitempty"`
+}
+
+// Last event ID handed out
+var lastEventID atomic.Uint64
+
+// NewEvent creates an event of the given type with a new ID and the current time
+func NewEvent(eventType string) Event {
+	return Event{
+		ID:   lastEventID.Add(1),
+		Type: eventType,
+		Time: time.Now().UTC(),
+	}
+}
+
+// SendEvent delivers an event to a client, JSON clients get the event itself and
+// all other clients get text
+func SendEvent(conn net.Conn, ev Event, text string) {
+	if c, ok := conn.(*ClientConn); ok && c.holdMissed(ev, text) {
+		return
+	}
+	if c, ok := conn.(*ClientConn); ok && c.IsJSON() {
+		c.WriteEvent(ev)
+		return
+	}
+	conn.Write([]byte(text))
+}
+
+// Notify sends a notice that is not the answer to anything the client asked,
+// like idle warnings sent from timers. JSON clients get it as an event right
+// away, even while one of their requests is running.
+func Notify(conn net.Conn, text string) {
+	if c, ok := conn.(*ClientConn); ok && c.IsJSON() {
+		if lines, failed := jsonLines(text); len(lines) > 0 {
+			c.writeJSONLines(lines, failed)
+		}
+		return
+	}
+	conn.Write([]byte(text))
+}
+
+// userEvent builds an event about a user, like a join or a leave
+func userEvent(eventType string, user *UserInfo) Event {
+	ev := NewEvent(eventType)
+	ev.Room = user.room
+	ev.Name = user.name
+	ev.Color = colorName(user.colorCode)
+	return ev
+}
+
+// chatEvent builds the event for a public chat message
+func chatEvent(sender *UserInfo, text string) Event {
+	ev := NewEvent(EventMessage)
+	ev.Room = sender.room
+	ev.From = sender.name
+	ev.Color = colorName(sender.colorCode)
+	ev.Text = text
+	ev.HTML = MarkupToHTML(text)
+	return ev
+}
+
+// dmEvent builds the event for a direct message
+func dmEvent(from, colorCode string, to []string, text string, sentAt time.Time) Event {
+	ev := NewEvent(EventDM)
+	ev.Time = sentAt.UTC()
+	ev.From = from
+	ev.To = to
+	ev.Color = colorName(colorCode)
+	ev.Text = text
+	return ev
+}
@@ -1,16 +1,265 @@
 package utilities
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
 	"math"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 // TODO disconnect offline users, format messages and logs
 
+func init() {
+	registerBuiltinCommands()
+}
+
+// registerBuiltinCommands registers the commands every chat server has
+func registerBuiltinCommands() {
+	mustRegisterCommand(&Command{
+		Name:    "help",
+		Aliases: []string{"h"},
+		Help:    "Show the available commands",
+		Run: func(conn net.Conn, args []string) {
+			mu.Lock()
+			user := Clients[conn]
+			mu.Unlock()
+			conn.Write([]byte(PrintUsage(user, nil)))
+		},
+	})
+	mustRegisterCommand(&Command{
+		Name:    "rename",
+		Aliases: []string{"r"},
+		Args:    "<new name>",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Help:    "Change your name",
+		Run: func(conn net.Conn, args []string) {
+			Rename(conn, args[0])
+		},
+	})
+	mustRegisterCommand(&Command{
+		Name:    "color",
+		Aliases: []string{"c"},
+		Args:    "[name or #rrggbb]",
+		MaxArgs: 1,
+		Help:    "Change your color",
+		Run: func(conn net.Conn, args []string) {
+			if len(args) == 1 {
+				SetColor(conn, args[0])
+				return
+			}
+			ChangeColor(conn)
+		},
+	})
+	mustRegisterCommand(&Command{
+		Name:    "users",
+		Aliases: []string{"u"},
+		Help:    "List online users",
+		Run: func(conn net.Conn, args []string) {
+			ListOnlineUsers(conn)
+		},
+	})
+	mustRegisterCommand(&Command{
+		Name:    "whois",
+		Args:    "<user>",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Help:    "Show details about a user",
+		Run: func(conn net.Conn, args []string) {
+			Whois(conn, args[0])
+		},
+	})
+	mustRegisterCommand(&Command{
+		Name:    "away",
+		Args:    "[reason]",
+		MaxArgs: Unlimited,
+		Help:    "Mark yourself away",
+		Run: func(conn net.Conn, args []string) {
+			SetAway(conn, strings.Join(args, " "))
+		},
+	})
+	mustRegisterCommand(&Command{
+		Name: "back",
+		Help: "Clear your away status",
+		Run: func(conn net.Conn, args []string) {
+			SetBack(conn)
+		},
+	})
+	mustRegisterCommand(&Command{
+		Name:    "status",
+		Args:    "[text]",
+		MaxArgs: Unlimited,
+		Help:    "Set your status, empty to clear",
+		Run: func(conn net.Conn, args []string) {
+			SetStatus(conn, strings.Join(args, " "))
+		},
+	})
+	mustRegisterCommand(&Command{
+		Name:    "dm",
+		Args:    "<reciever>[,<reciever>...] <private message>",
+		MinArgs: 2,
+		MaxArgs: Unlimited,
+		Help:    "Send a private message",
+		Run: func(conn net.Conn, args []string) {
+			PrivateMessage(args[0], strings.Join(args[1:], " "), conn)
+		},
+	})
+	mustRegisterCommand(&Command{
+		Name:    "reply",
+		Args:    "<private message>",
+		MinArgs: 1,
+		MaxArgs: Unlimited,
+		Help:    "Reply to everyone in your last conversation",
+		Run: func(conn net.Conn, args []string) {
+			mu.Lock()
+			name := Clients[conn].name
+			mu.Unlock()
+
+			others := LastConversationWith(name)
+			if len(others) == 0 {
+				conn.Write([]byte(FormatErrorMessage("\nError: You have no conversation to reply to.") + "\n"))
+				return
+			}
+			PrivateMessage(strings.Join(others, ","), strings.Join(args, " "), conn)
+		},
+	})
+	mustRegisterCommand(&Command{
+		Name: "inbox",
+		Help: "List your conversations",
+		Run: func(conn net.Conn, args []string) {
+			mu.Lock()
+			name := Clients[conn].name
+			mu.Unlock()
+			ShowInbox(conn, name)
+		},
+	})
+	mustRegisterCommand(&Command{
+		Name:    "dmhistory",
+		Args:    "<user>[,<user>...] [number of messages]",
+		MinArgs: 1,
+		MaxArgs: 2,
+		Help:    "Show a conversation",
+		Run: func(conn net.Conn, args []string) {
+			count := DefaultDMHistoryCount
+			if len(args) == 2 {
+				n, err := strconv.Atoi(args[1])
+				if err != nil || n <= 0 {
+					conn.Write([]byte(FormatErrorMessage("\nError: Message count must be a positive number.") + "\n"))
+					return
+				}
+				count = n
+			}
+
+			mu.Lock()
+			name := Clients[conn].name
+			mu.Unlock()
+			ShowDMHistory(conn, name, strings.Split(args[0], ","), count)
+		},
+	})
+	mustRegisterCommand(&Command{
+		Name:    "mode",
+		Args:    "[plain|ansi|256color]",
+		MaxArgs: 1,
+		Help:    "Change how messages are displayed",
+		Run: func(conn net.Conn, args []string) {
+			ChangeMode(conn, strings.Join(args, ""))
+		},
+	})
+	mustRegisterCommand(&Command{
+		Name:    "register",
+		Args:    "<password>",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Help:    "Register your name with a password",
+		Run: func(conn net.Conn, args []string) {
+			Register(conn, args[0])
+		},
+	})
+	mustRegisterCommand(&Command{
+		Name:    "set",
+		Args:    "[<setting> <value>]",
+		MaxArgs: 2,
+		Help:    "Show or change your settings",
+		Run: func(conn net.Conn, args []string) {
+			switch len(args) {
+			case 0:
+				ShowPreferences(conn)
+			case 1:
+				conn.Write([]byte(FormatErrorMessage("\nError: Give a value for "+args[0]+", type /set to see the settings.") + "\n"))
+			default:
+				SetPreference(conn, args[0], args[1])
+			}
+		},
+	})
+	mustRegisterCommand(&Command{
+		Name:    "tz",
+		Args:    "[Area/City|UTC|server]",
+		MaxArgs: 1,
+		Help:    "Show or change the timezone of your timestamps",
+		Run: func(conn net.Conn, args []string) {
+			if len(args) == 0 {
+				ShowTimezone(conn)
+				return
+			}
+			SetPreference(conn, "timezone", args[0])
+		},
+	})
+	mustRegisterCommand(&Command{
+		Name:    "ignore",
+		Args:    "<user>",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Help:    "Hide the messages of a user",
+		Run: func(conn net.Conn, args []string) {
+			Ignore(conn, args[0])
+		},
+	})
+	mustRegisterCommand(&Command{
+		Name:    "unignore",
+		Args:    "<user>",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Help:    "Show the messages of an ignored user again",
+		Run: func(conn net.Conn, args []string) {
+			Unignore(conn, args[0])
+		},
+	})
+	mustRegisterCommand(&Command{
+		Name: "ignored",
+		Help: "List the users you ignore",
+		Run: func(conn net.Conn, args []string) {
+			ListIgnored(conn)
+		},
+	})
+	mustRegisterCommand(&Command{
+		Name:    "oper",
+		Args:    "<password>",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Help:    "Become an operator",
+		Run: func(conn net.Conn, args []string) {
+			Oper(conn, args[0])
+		},
+	})
+	mustRegisterCommand(&Command{
+		Name:    "quit",
+		Aliases: []string{"q"},
+		Help:    "Logout",
+		Run: func(conn net.Conn, args []string) {
+			mu.Lock()
+			name := Clients[conn].name
+			mu.Unlock()
+			Logout(conn, name)
+		},
+	})
+}
+
+// Flags runs the command a message starts with, messages that are not commands
+// are returned with the sender's name to be sent to the chat
 func Flags(conn net.Conn, message string) (string, string) {
 	// Update last active timestamp
 	UpdateLastActive(conn)
@@ -18,71 +267,43 @@ func Flags(conn net.Conn, message string) (string, string) {
 	SlicedMsg := strings.Fields(message)
 	flag := SlicedMsg[0]
 
-	// Helper function to handle command validation and error messages
-	validateCommand := func(expectedArgs int, minArgs int, exactMatch bool) bool {
-		valid := true
-
-		if exactMatch && len(SlicedMsg) != expectedArgs {
-			valid = false
-		} else if !exactMatch && len(SlicedMsg) < minArgs {
-			valid = false
-		}
-
-		if !valid {
-			conn.Write([]byte("\033[A\033[2K"))
-			errorMsg := FormatErrorMessage("\nError - Wrong command: " + Clients[conn].color + message + Reset)
-			conn.Write([]byte(errorMsg + "\n"))
-			conn.Write([]byte(PrintUsage(flag)))
-		}
-
-		return valid
+	mu.Lock()
+	user, exists := Clients[conn]
+	mu.Unlock()
+	if !exists {
+		return "", ""
 	}
 
-	switch flag {
-	case "-h", "--help":
-		if validateCommand(1, 1, true) {
-			conn.Write([]byte("\033[A\033[2K"))
-			conn.Write([]byte(PrintUsage("all")))
-		}
-	case "-r", "--rename":
-		if validateCommand(2, 2, true) {
-			conn.Write([]byte("\033[A\033[2K"))
-			newName := SlicedMsg[1]
-			Rename(conn, newName)
-		}
-	case "-q", "--quit":
-		if validateCommand(1, 1, true) {
-			conn.Write([]byte("\033[A\033[2K"))
-			Logout(conn, Clients[conn].name)
+	var cmd *Command
+	switch {
+	case strings.HasPrefix(message, CommandPrefix+CommandPrefix):
+		// Escaped prefix, send the rest as a normal message
+		return user.name, message[len(CommandPrefix):]
+	case strings.HasPrefix(flag, CommandPrefix):
+		cmd = findCommand(strings.TrimPrefix(flag, CommandPrefix))
+		if cmd == nil {
+			ClearInputLine(conn)
+			conn.Write([]byte(FormatErrorMessage("\nError: Unknown command "+flag+". Use /help to see available commands.") + "\n"))
 			return "", ""
 		}
-	case "-dm":
-		if validateCommand(3, 3, false) {
-			reciever := SlicedMsg[1]
-			scrtMsg := strings.Join(SlicedMsg[2:], " ")
-			conn.Write([]byte("\033[A\033[2K"))
-			PrivateMessage(reciever, scrtMsg, conn)
-		}
-	case "-c", "--color":
-		if validateCommand(1, 1, true) {
-			conn.Write([]byte("\033[A\033[2K"))
-			ChangeColor(conn)
-		}
-	case "-u", "--users":
-		if validateCommand(1, 1, true) {
-			conn.Write([]byte("\033[A\033[2K"))
-			ListOnlineUsers(conn)
+	case ServerConfig.DashCommands && strings.HasPrefix(flag, "-"):
+		// Old style -h and --help commands, unknown ones are normal messages
+		cmd = findCommand(strings.TrimPrefix(strings.TrimPrefix(flag, "-"), "-"))
+		if cmd == nil {
+			return user.name, message
 		}
 	default:
-		return Clients[conn].name, message
+		return user.name, message
 	}
+
+	runCommand(conn, user, cmd, message, SlicedMsg[1:])
 	return "", ""
 }
 
 func Logout(conn net.Conn, name string) {
 
 	mu.Lock()
-	_, exists := Clients[conn]
+	info, exists := Clients[conn]
 	if !exists {
 		mu.Unlock()
 		return // Client already removed, avoid crashing
@@ -93,11 +314,19 @@ func Logout(conn net.Conn, name string) {
 
 	// Remove the client from tracking
 	delete(Clients, conn)
-	delete(remoteAddresses, ipAddr)
+	releaseAddress(ipAddr)
+	stopIdleTimer(conn)
+	forgetColorMenu(conn)
+	lastSession := len(sessionsOf(info)) == 0
+	if lastSession && !info.account {
+		forgetGuest(info.name)
+	}
 	mu.Unlock()
 
-	// Broadcast the exit message with the client's color
-	BroadCast(conn, FormatExitMessage(name), true)
+	// Broadcast the exit message with the client's color, users with other sessions stay
+	if lastSession {
+		BroadCast(conn, FormatExitMessage(name), userEvent(EventLeave, info))
+	}
 
 	// Add a goodbye message to the client
 	conn.Write([]byte("\nYou have left the chat. Goodbye!\n"))
@@ -111,35 +340,42 @@ func Logout(conn net.Conn, name string) {
 
 // Rename changes a user's name
 func Rename(conn net.Conn, newName string) {
+	newName = strings.TrimSpace(SanitizeName(newName))
+
+	// The name is checked and taken under one lock, so nobody can take it in between
 	mu.Lock()
 	defer mu.Unlock()
 
-	// Check if the new name is valid
-	if newName == "" || len(newName) > 20 {
-		conn.Write([]byte("Name cannot be empty or more than 20 characters\n"))
+	// Check if the new name is valid and free, changing the case of your own name is allowed
+	if problem := checkName(conn, newName); problem != "" {
+		conn.Write([]byte(problem + "\n"))
 		return
 	}
 
-	// Check if the new name already exists
-	var nameExists bool
-
 	// Store the old name for the announcement
 	oldName := Clients[conn].name
-
-	for connection, info := range Clients {
-		if info.name == newName && connection != conn || newName == oldName {
-			conn.Write([]byte("Username: " + newName + " already exists, choose a different name\n"))
-			nameExists = true
-			break
-		}
+	if newName == oldName {
+		conn.Write([]byte("Your name already is " + newName + "\n"))
+		return
 	}
 
-	if nameExists {
+	// Registered names need their password, registered users take their account along
+	account := Clients[conn].account
+	if IsRegistered(newName) && !(account && sameName(newName, oldName)) {
+		conn.Write([]byte(FormatErrorMessage("\nError: "+newName+" is registered, log in with its password to use it.") + "\n"))
 		return
 	}
+	if account {
+		renameAccount(oldName, newName)
+	} else {
+		// The conversations of a guest stay with the old name, which anyone may take now
+		dropConversations(oldName)
+	}
 
-	// Update the name
+	// Update the name, whoever ignores the user keeps ignoring them
 	Clients[conn].name = newName
+	renameIgnored(oldName, newName)
+	MarkKnownUser(newName)
 
 	// Notify the user
 	conn.Write([]byte("You have changed your name to " + newName + "\n"))
@@ -147,88 +383,292 @@ func Rename(conn net.Conn, newName string) {
 	// Announce the name change to all users
 	nameChangeMsg := FormatSystemMessage(oldName + " changed their name to " + Clients[conn].color + newName + Reset)
 
-	chatLogger.Log("chat", "User "+oldName+" "+IpAddr+" has changed their name to "+newName)
+	chatLogger.Log("chat", "User "+oldName+" "+remoteIP(conn)+" has changed their name to "+newName)
 
 	// Add to history
 	AddToHistory(nameChangeMsg)
 
+	renameEvent := userEvent(EventRename, Clients[conn])
+	renameEvent.Name = oldName
+	renameEvent.NewName = newName
+	PublishEvent(renameEvent)
+
 	// Broadcast to all clients
 	for client := range Clients {
 		if client != conn { // Optional: don't send to the user who changed their name
-			client.Write([]byte(nameChangeMsg + "\n"))
+			SendEvent(client, renameEvent, stamp(client, renameEvent.Time)+nameChangeMsg+"\n")
 		}
 	}
 }
 
+// MaxGroupSize is the maximum number of receivers of a single direct message
+const MaxGroupSize = 9
+
+// PrivateMessage sends a direct message to one receiver or a comma separated group of receivers
 func PrivateMessage(reciever, msg string, conn net.Conn) {
+	reciever = SanitizeName(reciever)
+	msg = strings.TrimSpace(SanitizeInput(msg))
+	if msg == "" {
+		conn.Write([]byte(FormatErrorMessage("\nError: Empty message.") + "\n"))
+		return
+	}
+
+	mu.Lock()
 	sender := Clients[conn]
-	var recieverConn net.Conn
+	mu.Unlock()
 
-	for client := range Clients {
-		if conn != client {
-			if Clients[client].name == reciever {
-				recieverConn = client
+	// Collect the unique receivers of the message
+	var receivers []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(reciever, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[NameKey(name)] {
+			continue
+		}
+		if sameName(name, sender.name) {
+			conn.Write([]byte(FormatErrorMessage("\nError: You cannot send a private message to yourself.") + "\n"))
+			return
+		}
+		seen[NameKey(name)] = true
+		receivers = append(receivers, name)
+	}
+	if len(receivers) == 0 {
+		conn.Write([]byte(FormatErrorMessage("\nError: User not found.") + "\n"))
+		return
+	}
+	if len(receivers) > MaxGroupSize {
+		conn.Write([]byte(FormatErrorMessage("\nError: A group message can have at most "+fmt.Sprint(MaxGroupSize)+" receivers.") + "\n"))
+		return
+	}
 
-				goto Found // If receiver exists, skip error message
-			}
+	// Find the sessions of the receivers that are online, the others must be
+	// registered, and the sender's sessions to show the sent message in.
+	// Lost connections waiting to be resumed count as offline, so their
+	// messages are queued and reach them when they come back
+	recieverConns := make(map[string][]net.Conn)
+	suspended := make(map[string]*UserInfo)
+	present := make(map[string]string) // spelling of the receivers who are in the chat
+	mu.Lock()
+	for client, info := range Clients {
+		if client == conn || !seen[NameKey(info.name)] {
+			continue
 		}
+		present[NameKey(info.name)] = info.name
+		if suspendedConn(client) {
+			suspended[NameKey(info.name)] = info
+			continue
+		}
+		recieverConns[info.name] = append(recieverConns[info.name], client)
 	}
-	conn.Write([]byte(FormatErrorMessage("\nError: User not found.") + "\n"))
-	return
+	senderConns := sessionsOf(sender)
+	mu.Unlock()
 
-Found:
-	receiverIpAddr := recieverConn.RemoteAddr().(*net.TCPAddr).IP.String()
-	// Log format for DMs
-	chatLogger.Log("chat - DM", "[From "+sender.name+" "+IpAddr+" to "+reciever+" "+receiverIpAddr+" ]: "+strings.TrimSpace(msg))
+	// Use the names as the users spell them, only registered users get messages
+	// while they are away, a guest's name may be taken by anyone after them
+	for i, name := range receivers {
+		if spelled, exists := present[NameKey(name)]; exists {
+			receivers[i] = spelled
+			continue
+		}
+		known, exists := KnownUserName(name)
+		if !exists || !IsRegistered(name) {
+			conn.Write([]byte(FormatErrorMessage("\nError: User "+name+" not found.") + "\n"))
+			return
+		}
+		receivers[i] = known
+	}
+
+	now := time.Now()
+	members := append([]string{sender.name}, receivers...)
+	var logTargets []string
+	var delivered int // receivers who got the message or have it queued
+	var queued []string
+	var awayReplies []string
 
 	// Format messages using the FormatPrivateMessage function
-	receiverMsg := FormatPrivateMessage(sender.name, reciever, msg, false)
-	senderMsg := FormatPrivateMessage(sender.name, reciever, msg, true)
+	receiverMsg := FormatPrivateMessage(sender.name, receivers, msg, false)
+	senderMsg := FormatPrivateMessage(sender.name, receivers, msg, true)
+
+	for _, name := range receivers {
+		sessions, online := recieverConns[name]
+		if online {
+			recieverConn := sessions[0]
+			receiverIpAddr := recieverConn.RemoteAddr().(*net.TCPAddr).IP.String()
+
+			// Receivers who ignore the sender never see the message, the sender is not told
+			mu.Lock()
+			info, exists := Clients[recieverConn]
+			ignored := exists && info.ignores(sender.name)
+			mu.Unlock()
+			delivered++
+			if ignored {
+				logTargets = append(logTargets, name+" "+receiverIpAddr+" (ignored)")
+				continue
+			}
+			logTargets = append(logTargets, name+" "+receiverIpAddr)
+
+			for _, session := range sessions {
+				SendEvent(session, dmEvent(sender.name, sender.colorCode, receivers, msg, now), sender.color+stamp(session, now)+receiverMsg+Reset)
+			}
+			SetLastConversation(name, members)
+
+			// Let the sender know the receiver is away
+			mu.Lock()
+			if info, exists := Clients[recieverConn]; exists && info.away {
+				awayReplies = append(awayReplies, awayNotice(info))
+			}
+			mu.Unlock()
+			continue
+		}
+
+		mu.Lock()
+		info, isSuspended := suspended[NameKey(name)]
+		ignored := isSuspended && info.ignores(sender.name)
+		mu.Unlock()
+		if ignored || accountIgnores(name, sender.name) {
+			delivered++
+			logTargets = append(logTargets, name+" (offline, ignored)")
+			continue
+		}
 
-	recieverConn.Write([]byte(sender.color + receiverMsg + Reset))
-	conn.Write([]byte(sender.color + senderMsg + Reset))
+		// Queue the message for a receiver who has logged in before
+		err := QueueOfflineMessage(OfflineMessage{
+			From:      sender.name,
+			To:        name,
+			Group:     receivers,
+			Color:     sender.color,
+			ColorCode: sender.colorCode,
+			Text:      msg,
+			SentAt:    now,
+		})
+		if err != nil {
+			conn.Write([]byte(FormatErrorMessage("\nError: "+err.Error()+", the message was not sent to "+name+".") + "\n"))
+			continue
+		}
+		delivered++
+		logTargets = append(logTargets, name+" (offline)")
+		queued = append(queued, name)
+	}
+
+	// Nothing is recorded or shown as sent when no receiver got the message
+	if delivered == 0 {
+		return
+	}
+
+	// Log format for DMs
+	chatLogger.Log("chat - DM", "[From "+sender.name+" "+remoteIP(conn)+" to "+strings.Join(logTargets, ", ")+" ]: "+strings.TrimSpace(msg))
+
+	// Keep the message in the conversation history
+	RecordDirectMessage(members, DirectMessage{
+		From:   sender.name,
+		Color:  sender.color,
+		Text:   msg,
+		SentAt: now,
+	})
+	SetLastConversation(sender.name, members)
+
+	for _, session := range senderConns {
+		SendEvent(session, dmEvent(sender.name, sender.colorCode, receivers, msg, now), sender.color+stamp(session, now)+senderMsg+Reset)
+	}
+	if len(queued) > 0 {
+		conn.Write([]byte(strings.Join(queued, ", ") + " is offline, message queued for offline delivery.\n"))
+	}
+	for _, reply := range awayReplies {
+		conn.Write([]byte(stamp(conn, now) + reply))
+	}
 }
 
-// ChangeColor allows a user to change their color
+var (
+	// Mutex for protecting the color menus
+	colorMenusMu sync.Mutex
+
+	// Color menus waiting for the user's choice, by connection
+	colorMenus = make(map[net.Conn][]PaletteColor)
+)
+
+// ChangeColor shows the color menu, the user's next line is their choice
 func ChangeColor(conn net.Conn) {
-	client, exists := Clients[conn]
+	mu.Lock()
+	_, exists := Clients[conn]
+	mu.Unlock()
 	if !exists {
 		conn.Write([]byte(FormatErrorMessage("\nError: Client not found.") + "\n"))
 		return
 	}
 
+	// JSON clients cannot answer a menu, their next line is a request
+	if c, ok := conn.(*ClientConn); ok && c.IsJSON() {
+		conn.Write([]byte(FormatErrorMessage("\nError: Name the color, like /color red.") + "\n"))
+		return
+	}
+
 	// Show color menu
-	conn.Write([]byte(ColorMenu))
+	available := availableColors(conn)
+	PrintColorMenu(conn, available)
 
-	// Read user's color choice
-	reader := bufio.NewReader(conn)
-	colorChoice, err := reader.ReadString('\n')
-	if err != nil {
-		return
+	colorMenusMu.Lock()
+	colorMenus[conn] = available
+	colorMenusMu.Unlock()
+}
+
+// answerColorMenu takes a line as the choice of the color menu shown to a
+// user, it reports false when no menu was waiting for an answer
+func answerColorMenu(conn net.Conn, colorChoice string) bool {
+	colorMenusMu.Lock()
+	available, waiting := colorMenus[conn]
+	delete(colorMenus, conn)
+	colorMenusMu.Unlock()
+	if !waiting {
+		return false
+	}
+
+	colorChoice = strings.TrimSpace(SanitizeInput(colorChoice))
+	if colorChoice == "" {
+		_, colorChoice = freeColor(conn)
+	}
+
+	// Try again if the color is taken
+	if SetColor(conn, menuChoice(available, colorChoice)) == errColorInUse {
+		ChangeColor(conn)
+	}
+	return true
+}
+
+// forgetColorMenu drops the color menu of a connection that closed
+func forgetColorMenu(conn net.Conn) {
+	colorMenusMu.Lock()
+	delete(colorMenus, conn)
+	colorMenusMu.Unlock()
+}
+
+// errColorInUse is returned by SetColor when someone else has the color
+var errColorInUse = errors.New("color in use")
+
+// SetColor changes a user's color to a menu number or color name
+func SetColor(conn net.Conn, colorChoice string) error {
+	mu.Lock()
+	client, exists := Clients[conn]
+	mu.Unlock()
+	if !exists {
+		return errors.New("client not found")
 	}
-	colorChoice = strings.TrimSpace(colorChoice)
 
 	// Get the new color
 	newColor, colorCode := GetColorByChoice(colorChoice)
 
 	if newColor == "" {
 		conn.Write([]byte(FormatErrorMessage("\nError: Invalid color choice. Your color remains unchanged.") + "\n"))
-		return
+		return errors.New("invalid color")
 	}
 
 	// Check if color is already in use
-	mu.Lock()
-	for c, info := range Clients {
-		if c != conn && info.colorCode == colorCode {
-			mu.Unlock()
-			conn.Write([]byte(FormatErrorMessage("\nError: This color is already in use. Please choose another color.") + "\n"))
-			// Try again
-			ChangeColor(conn)
-			return
-		}
+	if colorInUse(conn, colorCode) {
+		conn.Write([]byte(FormatErrorMessage("\nError: This color is already in use. Please choose another color.") + "\n"))
+		return errColorInUse
 	}
 
 	// Update client's color
+	mu.Lock()
 	client.color = newColor
 	client.colorCode = colorCode
 	mu.Unlock()
@@ -240,12 +680,15 @@ func ChangeColor(conn net.Conn) {
 	changeMsg := "User " + client.name + " changed their color to " + newColor + client.name + Reset + "\n"
 
 	mu.Lock()
+	colorEvent := userEvent(EventColor, client)
+	PublishEvent(colorEvent)
 	for connection := range Clients {
 		if connection != conn {
-			connection.Write([]byte(changeMsg))
+			SendEvent(connection, colorEvent, changeMsg)
 		}
 	}
 	mu.Unlock()
+	return nil
 }
 
 // ListOnlineUsers displays all currently connected users
@@ -261,7 +704,21 @@ func ListOnlineUsers(conn net.Conn) {
 	userList := "\nOnline Users:\n"
 	i := 1
 	now := time.Now()
+	listed := make(map[*UserInfo]bool)
 	for _, client := range Clients {
+		// Users with several sessions are listed once
+		if listed[client] {
+			continue
+		}
+		listed[client] = true
+		sessions := ""
+		if n := connectedSessions(client); n > 1 {
+			sessions = fmt.Sprintf(" (%d sessions)", n)
+		}
+		if reconnecting(client) {
+			sessions += " (reconnecting)"
+		}
+
 		joinedAgo := now.Sub(client.joinedAt)
 
 		// Calculate minutes, rounding up to at least 1 minute
@@ -270,8 +727,8 @@ func ListOnlineUsers(conn net.Conn) {
 			minutes = 1 // Ensure it's at least 1 minute
 		}
 
-		userList += fmt.Sprintf("%d. %s%s%s (joined %d minutes ago)\n",
-			i, client.color, client.name, Reset, minutes)
+		userList += fmt.Sprintf("%d. %s%s%s (joined %d minutes ago)%s%s\n",
+			i, client.color, client.name, Reset, minutes, sessions, presenceText(client))
 		i++
 	}
 
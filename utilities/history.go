@@ -1,23 +1,40 @@
 package utilities
 
 import (
+	"html"
 	"net"
 	"strings"
+	"time"
 )
 
 // Maximum number of messages to keep in history
 const MaxHistorySize = 20
 
+// historyEntry is one line of the chat history without its timestamp, body is
+// the text of a chat message at the end of the line, kept to render its markup,
+// and from its sender
+type historyEntry struct {
+	at   time.Time
+	line string
+	body string
+	from string
+}
+
 // Stores chat history
-var messageHistory []string
+var messageHistory []historyEntry
 
 // AddToHistory adds a message to the chat history, maintaining the maximum size
 func AddToHistory(msg string) {
+	addHistoryEntry(msg, "", "")
+}
+
+// addHistoryEntry adds a line to the chat history, body is the chat message it ends with
+func addHistoryEntry(msg, from, body string) {
 	// Clean the message
-	cleanMsg := strings.TrimSpace(msg)
+	cleanMsg := strings.TrimRight(msg, " \n")
 
 	// Add the message to history
-	messageHistory = append(messageHistory, cleanMsg)
+	messageHistory = append(messageHistory, historyEntry{at: time.Now().UTC(), line: cleanMsg, body: body, from: from})
 
 	// If we exceed the maximum size, remove the oldest messages
 	if len(messageHistory) > MaxHistorySize {
@@ -33,12 +50,33 @@ func SendMessageHistory(conn net.Conn) {
 
 	// Only show chat history if there are messages
 	if len(messageHistory) > 0 {
-		// Add chat history header
-		conn.Write([]byte("\nChat History:\n"))
+		// Add chat history header, JSON clients can tell history by the event type
+		if c, ok := conn.(*ClientConn); !ok || !c.IsJSON() {
+			conn.Write([]byte("\nChat History:\n"))
+		}
+
+		// Users choose how much history they see and whose messages
+		client, exists := Clients[conn]
+		if !exists {
+			client = &UserInfo{}
+		}
+		entries := messageHistory
+		if count := client.prefs.historyCount(); count < len(entries) {
+			entries = entries[len(entries)-count:]
+		}
+		for _, entry := range entries {
+			if entry.from != "" && client.ignores(entry.from) {
+				continue
+			}
 
-		for _, msg := range messageHistory {
-			// Send the message with proper formatting
-			conn.Write([]byte(strings.TrimSpace(msg) + "\n"))
+			// Send the message with proper formatting, stamped in the client's timezone
+			ev := NewEvent(EventHistory)
+			ev.Time = entry.at
+			ev.Text = stamp(conn, entry.at) + stripEscapes(entry.line)
+			if entry.body != "" {
+				ev.HTML = withMarkup(ev.Text, stripEscapes(entry.body), MarkupToHTML, html.EscapeString)
+			}
+			SendEvent(conn, ev, stamp(conn, entry.at)+withMarkup(entry.line, entry.body, MarkupToANSI, plainText)+"\n")
 		}
 	}
 }
@@ -1,22 +1,41 @@
 package utilities
 
 import (
+	"fmt"
 	"net"
 	"sync"
 	"time"
 )
 
 const (
-	//Just for audits
-	// IdleTimeout   = 10 * time.Second
-	// WarningTime   = 5 * time.Second
-	// CheckInterval = 1 * time.Second
-
+	// Default idle thresholds of normal users, operators and bots are never idle by default
 	IdleTimeout   = 10 * time.Minute
 	WarningTime   = 8 * time.Minute
-	CheckInterval = 2 * time.Minute
+	AutoAwayAfter = 5 * time.Minute
 )
 
+// Roles an idle policy can be configured for
+const (
+	RoleUser     = "user"
+	RoleOperator = "operator"
+	RoleBot      = "bot" // clients using the JSON protocol
+)
+
+// Actions taken when a user reaches the idle timeout
+const (
+	IdleDisconnect = "disconnect"
+	IdleAway       = "away"
+)
+
+// IdlePolicy says what happens to the users of a role while they are idle,
+// a zero duration turns that step off
+type IdlePolicy struct {
+	AwayAfter Duration `json:"away_after"` // mark the user away
+	WarnAfter Duration `json:"warn_after"` // warn that the user will be disconnected
+	Timeout   Duration `json:"timeout"`    // take the action
+	Action    string   `json:"action"`     // disconnect, the default, or away
+}
+
 // Add these variables at the package level
 var (
 	// Mutex for protecting the inWarningResponse map
@@ -30,109 +49,213 @@ var (
 
 	// Map to track which users have been warned
 	warnedUsers = make(map[net.Conn]bool)
+
+	// Timer of each session that fires at the next step of its idle policy, guarded by mu
+	idleTimers = make(map[net.Conn]*time.Timer)
 )
 
-// StartIdleTimeoutChecker starts a goroutine that periodically checks for idle users
-func StartIdleTimeoutChecker() {
-
-	go func() {
-		for {
-			time.Sleep(CheckInterval)
-
-			mu.Lock()
-			now := time.Now()
-			var idleConns []net.Conn
-			var warningConns []net.Conn
-
-			// Find idle and warning connections
-			for conn, info := range Clients {
-				idleTime := now.Sub(info.lastActive)
-
-				if idleTime > IdleTimeout {
-					idleConns = append(idleConns, conn)
-
-					warnedUsersMu.Lock()
-					delete(warnedUsers, conn)
-					warnedUsersMu.Unlock()
-
-				} else if idleTime > WarningTime {
-					warnedUsersMu.Lock()
-					alreadyWarned := warnedUsers[conn]
-					warnedUsersMu.Unlock()
-
-					if !alreadyWarned {
-						warningConns = append(warningConns, conn)
-					}
-				} else {
-					// User is active, reset their warning status
-					warnedUsersMu.Lock()
-					if warnedUsers[conn] {
-						delete(warnedUsers, conn)
-					}
-					warnedUsersMu.Unlock()
-				}
-			}
-			mu.Unlock()
-
-			// Send warnings
-			for _, conn := range warningConns {
-				mu.Lock()
-				_, exists := Clients[conn]
-				mu.Unlock()
-
-				if exists {
-					warnedUsersMu.Lock()
-					warnedUsers[conn] = true
-					warnedUsersMu.Unlock()
-
-					// Mark this connection as in warning response mode
-					warningMu.Lock()
-					inWarningResponse[conn] = true
-					warningMu.Unlock()
-
-					PrintWarningMessage(conn)
-				}
-			}
-
-			// Disconnect idle users
-			for _, conn := range idleConns {
-				mu.Lock()
-				info, exists := Clients[conn]
-				mu.Unlock()
-
-				if exists {
-
-					// Notify the user
-					conn.Write([]byte("\033[1;31mYou have been disconnected due to inactivity.\033[0m\n"))
-
-					// Clean up warning response mode
-					warningMu.Lock()
-					delete(inWarningResponse, conn)
-					warningMu.Unlock()
-
-					// Get the IP address before deleting
-					ipAddr := conn.RemoteAddr().(*net.TCPAddr).IP.String()
-
-					mu.Lock()
-					// Remove from clients map
-					delete(Clients, conn)
-					// Remove from remoteAddresses map
-					delete(remoteAddresses, ipAddr)
-					mu.Unlock()
-
-					// Broadcast the exit message
-					BroadCast(conn, FormatExitMessage(info.name), true)
-
-					// Close the connection
-					conn.Close()
-
-					warnedUsersMu.Lock()
-					delete(warnedUsers, conn)
-					warnedUsersMu.Unlock()
-				}
-			}
+// idlePolicy returns the idle policy of a role, roles missing from the config keep the defaults
+func idlePolicy(role string) IdlePolicy {
+	if policy, ok := ServerConfig.Idle[role]; ok {
+		return policy
+	}
+	if role == RoleUser {
+		away := Duration{AutoAwayAfter}
+		if ServerConfig.AutoAwayAfter != nil {
+			away = *ServerConfig.AutoAwayAfter
+		}
+		return IdlePolicy{
+			AwayAfter: away,
+			WarnAfter: Duration{WarningTime},
+			Timeout:   Duration{IdleTimeout},
+			Action:    IdleDisconnect,
+		}
+	}
+	return IdlePolicy{}
+}
+
+// checkIdlePolicies validates the idle setting together with auto_away_after
+func checkIdlePolicies() error {
+	if _, ok := ServerConfig.Idle[RoleUser]; ok && ServerConfig.AutoAwayAfter != nil {
+		return fmt.Errorf("auto_away_after is deprecated and has no effect next to idle.user, set idle.user.away_after instead")
+	}
+	for role := range ServerConfig.Idle {
+		if role != RoleUser && role != RoleOperator && role != RoleBot {
+			return fmt.Errorf("unknown role %s in idle, use user, operator or bot", role)
+		}
+	}
+
+	for _, role := range []string{RoleUser, RoleOperator, RoleBot} {
+		policy := idlePolicy(role)
+		away, warn, timeout := policy.AwayAfter.Duration, policy.WarnAfter.Duration, policy.Timeout.Duration
+
+		switch {
+		case away < 0 || warn < 0 || timeout < 0:
+			return fmt.Errorf("idle times of %s must not be negative", role)
+		case policy.Action != "" && policy.Action != IdleDisconnect && policy.Action != IdleAway:
+			return fmt.Errorf("idle action of %s must be disconnect or away", role)
+		case policy.Action == IdleAway && warn > 0:
+			return fmt.Errorf("idle warn_after of %s only applies to the disconnect action", role)
+		case warn > 0 && (timeout == 0 || warn >= timeout):
+			return fmt.Errorf("idle warn_after of %s must be shorter than its timeout", role)
+		case away > 0 && warn > 0 && away >= warn:
+			return fmt.Errorf("idle away_after of %s must be shorter than its warn_after", role)
+		case away > 0 && timeout > 0 && away >= timeout:
+			return fmt.Errorf("idle away_after of %s must be shorter than its timeout", role)
 		}
-	}()
+	}
+	return nil
+}
+
+// idleRole returns the role whose idle policy applies to a session, mu must be held
+func idleRole(conn net.Conn, client *UserInfo) string {
+	if client.operator {
+		return RoleOperator
+	}
+	if c, ok := conn.(*ClientConn); ok && c.IsJSON() {
+		return RoleBot
+	}
+	return RoleUser
+}
+
+// scheduleIdleCheck arms the idle timer of a session for the next step of its
+// policy, so warnings and disconnects happen on time, mu must be held
+func scheduleIdleCheck(conn net.Conn, client *UserInfo) {
+	policy := idlePolicy(idleRole(conn, client))
+	idle := time.Since(client.lastActive)
+
+	var next time.Duration
+	for _, step := range []time.Duration{policy.AwayAfter.Duration, policy.WarnAfter.Duration, policy.Timeout.Duration} {
+		if step > idle && (next == 0 || step < next) {
+			next = step
+		}
+	}
+
+	timer := idleTimers[conn]
+	switch {
+	case next == 0:
+		stopIdleTimer(conn)
+	case timer == nil:
+		idleTimers[conn] = time.AfterFunc(next-idle, func() { checkIdle(conn) })
+	default:
+		timer.Reset(next - idle)
+	}
+}
+
+// stopIdleTimer stops the idle timer of a session, mu must be held
+func stopIdleTimer(conn net.Conn) {
+	if timer := idleTimers[conn]; timer != nil {
+		timer.Stop()
+		delete(idleTimers, conn)
+	}
+}
+
+// checkIdle takes the steps of the idle policy a session has reached
+func checkIdle(conn net.Conn) {
+	mu.Lock()
+	client, exists := Clients[conn]
+	if !exists {
+		mu.Unlock()
+		return
+	}
+	policy := idlePolicy(idleRole(conn, client))
+	idle := time.Since(client.lastActive)
+
+	// Mark users away before they get the idle warning
+	if policy.AwayAfter.Duration > 0 && idle >= policy.AwayAfter.Duration {
+		markAutoAway(conn, client)
+	}
+
+	timedOut := policy.Timeout.Duration > 0 && idle >= policy.Timeout.Duration
+	if timedOut && policy.Action == IdleAway {
+		markAutoAway(conn, client)
+		timedOut = false
+	}
+	warn := !timedOut && policy.WarnAfter.Duration > 0 && idle >= policy.WarnAfter.Duration
+
+	scheduleIdleCheck(conn, client)
+	mu.Unlock()
+
+	if timedOut {
+		disconnectIdle(conn, client)
+	} else if warn {
+		warnIdle(conn)
+	}
+}
+
+// warnIdle tells a user they will be disconnected unless they answer
+func warnIdle(conn net.Conn) {
+	warnedUsersMu.Lock()
+	alreadyWarned := warnedUsers[conn]
+	warnedUsers[conn] = true
+	warnedUsersMu.Unlock()
+	if alreadyWarned {
+		return
+	}
+
+	// Mark this connection as in warning response mode
+	warningMu.Lock()
+	inWarningResponse[conn] = true
+	warningMu.Unlock()
+
+	PrintWarningMessage(conn)
+}
+
+// disconnectIdle removes a user who did not answer the idle warning
+func disconnectIdle(conn net.Conn, info *UserInfo) {
+	// Notify the user
+	Notify(conn, "\033[1;31mYou have been disconnected due to inactivity.\033[0m\n")
+
+	// Clean up warning response mode
+	warningMu.Lock()
+	delete(inWarningResponse, conn)
+	warningMu.Unlock()
+
+	// Get the IP address before deleting
+	ipAddr := conn.RemoteAddr().(*net.TCPAddr).IP.String()
+
+	mu.Lock()
+	if _, exists := Clients[conn]; !exists {
+		mu.Unlock()
+		return
+	}
+	// Remove from clients map
+	delete(Clients, conn)
+	// Remove from remoteAddresses map
+	releaseAddress(ipAddr)
+	stopIdleTimer(conn)
+	forgetColorMenu(conn)
+	lastSession := len(sessionsOf(info)) == 0
+	if lastSession && !info.account {
+		forgetGuest(info.name)
+	}
+	mu.Unlock()
+
+	// Broadcast the exit message, users with other sessions stay
+	if lastSession {
+		BroadCast(conn, FormatExitMessage(info.name), userEvent(EventLeave, info))
+	}
+
+	// Close the connection
+	conn.Close()
+
+	warnedUsersMu.Lock()
+	delete(warnedUsers, conn)
+	warnedUsersMu.Unlock()
+}
+
+// clearIdleWarning ends the warning response mode of a connection, it reports
+// whether the connection was warned
+func clearIdleWarning(conn net.Conn) bool {
+	warningMu.Lock()
+	inWarning := inWarningResponse[conn]
+	delete(inWarningResponse, conn)
+	warningMu.Unlock()
+
+	warnedUsersMu.Lock()
+	delete(warnedUsers, conn)
+	warnedUsersMu.Unlock()
+	return inWarning
 }
 
 // UpdateLastActive updates the timestamp of the user's last activity
@@ -142,5 +265,7 @@ func UpdateLastActive(conn net.Conn) {
 
 	if client, exists := Clients[conn]; exists {
 		client.lastActive = time.Now()
+		clearAutoAway(conn, client)
+		scheduleIdleCheck(conn, client)
 	}
 }
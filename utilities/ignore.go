@@ -0,0 +1,185 @@
+package utilities
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Maximum number of users one user can ignore
+const MaxIgnored = 50
+
+// The ignore lists follow people rather than names: renames rewrite the entries
+// of everyone who ignores the user, a guest is forgotten when they leave and
+// only registered users are saved with an account
+
+// ignores reports whether the user does not want to see messages from name, mu must be held
+func (u *UserInfo) ignores(name string) bool {
+	_, ignored := u.ignored[NameKey(name)]
+	return ignored
+}
+
+// ignoreName returns the name a sender is ignored by, webhook bots are
+// ignored by their integration whatever name they post under
+func (u *UserInfo) ignoreName() string {
+	if u.integration != "" {
+		return u.integration
+	}
+	return u.name
+}
+
+// ignoredNames returns the names a user ignores in alphabetical order, mu must be held
+func (u *UserInfo) ignoredNames() []string {
+	names := make([]string, 0, len(u.ignored))
+	for _, name := range u.ignored {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return NameKey(names[i]) < NameKey(names[j]) })
+	return names
+}
+
+// ignoreSet turns a saved ignore list into the lookup kept for a session
+func ignoreSet(names []string) map[string]string {
+	ignored := make(map[string]string, len(names))
+	for _, name := range names {
+		ignored[NameKey(name)] = name
+	}
+	return ignored
+}
+
+// Ignore hides the public messages and direct messages of a user
+func Ignore(conn net.Conn, name string) {
+	name = strings.TrimSpace(SanitizeName(name))
+	known, registered := name, IsRegistered(name)
+	if spelled, exists := KnownUserName(name); registered && exists {
+		known = spelled
+	}
+	// Integrations keep their name like accounts do
+	if integration := integrationNamed(name); integration != nil {
+		known, registered = integration.Name, true
+	}
+
+	mu.Lock()
+	client, online := Clients[conn]
+	if !online {
+		mu.Unlock()
+		return
+	}
+	if !registered {
+		// A guest name only stands for the person using it right now
+		target := onlineUser(name)
+		if target == nil {
+			mu.Unlock()
+			conn.Write([]byte(FormatErrorMessage("\nError: User "+name+" is not online, only registered users can be ignored while they are offline.") + "\n"))
+			return
+		}
+		known = target.name
+	}
+	switch {
+	case sameName(known, client.name):
+		mu.Unlock()
+		conn.Write([]byte(FormatErrorMessage("\nError: You cannot ignore yourself.") + "\n"))
+		return
+	case client.ignores(known):
+		mu.Unlock()
+		conn.Write([]byte("You already ignore " + known + "\n"))
+		return
+	case len(client.ignored) >= MaxIgnored:
+		mu.Unlock()
+		conn.Write([]byte(FormatErrorMessage(fmt.Sprintf("\nError: You can ignore at most %d users.", MaxIgnored)) + "\n"))
+		return
+	}
+	client.ignored[NameKey(known)] = known
+	account, owner, names := client.account, client.name, client.ignoredNames()
+	mu.Unlock()
+
+	if account {
+		saveAccountIgnored(owner, names)
+	}
+	conn.Write([]byte("You are now ignoring " + known + ", use /unignore " + known + " to see their messages again\n"))
+	if !registered {
+		conn.Write([]byte(known + " is a guest, they are ignored until they leave\n"))
+	}
+}
+
+// Unignore shows the messages of an ignored user again
+func Unignore(conn net.Conn, name string) {
+	name = strings.TrimSpace(SanitizeName(name))
+
+	mu.Lock()
+	client, online := Clients[conn]
+	if !online {
+		mu.Unlock()
+		return
+	}
+	known, ignored := client.ignored[NameKey(name)]
+	if !ignored {
+		mu.Unlock()
+		conn.Write([]byte(FormatErrorMessage("\nError: You do not ignore "+name+".") + "\n"))
+		return
+	}
+	delete(client.ignored, NameKey(name))
+	account, owner, names := client.account, client.name, client.ignoredNames()
+	mu.Unlock()
+
+	if account {
+		saveAccountIgnored(owner, names)
+	}
+
+	conn.Write([]byte("You see the messages of " + known + " again\n"))
+}
+
+// ListIgnored shows the users a user ignores
+func ListIgnored(conn net.Conn) {
+	mu.Lock()
+	client, online := Clients[conn]
+	if !online {
+		mu.Unlock()
+		return
+	}
+	names := client.ignoredNames()
+	account := client.account
+	mu.Unlock()
+
+	if len(names) == 0 {
+		conn.Write([]byte("You do not ignore anyone\n"))
+		return
+	}
+	list := "\nIgnored users:\n"
+	for _, name := range names {
+		list += "  " + name + "\n"
+	}
+	if !account {
+		list += "The list is kept until you leave, use /register to save it.\n"
+	}
+	conn.Write([]byte(list + "\n"))
+}
+
+// onlineUser returns the user who is online with a name, mu must be held
+func onlineUser(name string) *UserInfo {
+	for _, info := range Clients {
+		if sameName(info.name, name) {
+			return info
+		}
+	}
+	return nil
+}
+
+// renameIgnored moves the ignore entries of a user who renamed to the new name, mu must be held
+func renameIgnored(oldName, newName string) {
+	for _, info := range Clients {
+		if _, ignored := info.ignored[NameKey(oldName)]; ignored {
+			delete(info.ignored, NameKey(oldName))
+			info.ignored[NameKey(newName)] = newName
+		}
+	}
+}
+
+// forgetIgnored drops the ignore entries of a guest who left, so nobody who
+// takes the name later is hidden, mu must be held
+func forgetIgnored(name string) {
+	for _, info := range Clients {
+		delete(info.ignored, NameKey(name))
+	}
+}
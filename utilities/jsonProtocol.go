@@ -0,0 +1,296 @@
+package utilities
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Request is a line sent by a client using the JSON protocol
+type Request struct {
+	ID       string   `json:"id"`
+	Type     string   `json:"type"`
+	Protocol string   `json:"protocol"`
+	Name     string   `json:"name"`
+	Color    string   `json:"color"`
+	Password string   `json:"password"`
+	Resume   string   `json:"resume"`
+	Text     string   `json:"text"`
+	Command  string   `json:"command"`
+	Args     []string `json:"args"`
+}
+
+// jsonResponse collects the output of a command until its response is sent
+type jsonResponse struct {
+	id     string
+	lines  []string
+	failed bool
+}
+
+// HandleJSONClient serves a client connected to the JSON port
+func HandleJSONClient(conn net.Conn) {
+	c := NewClientConn(conn, false)
+	c.SetJSON()
+	handleClient(c)
+}
+
+// isJSONHandshake reports whether a line asks to switch to the JSON protocol
+func isJSONHandshake(line string) bool {
+	var req Request
+	if err := json.Unmarshal([]byte(strings.TrimSpace(line)), &req); err != nil {
+		return false
+	}
+	return req.Protocol == "json"
+}
+
+// IsJSON reports whether the client uses the JSON protocol
+func (c *ClientConn) IsJSON() bool {
+	c.termMu.Lock()
+	defer c.termMu.Unlock()
+
+	return c.json
+}
+
+// SetJSON switches the client to the JSON protocol
+func (c *ClientConn) SetJSON() {
+	c.termMu.Lock()
+	c.json = true
+	c.termMu.Unlock()
+
+	c.WriteEvent(Event{Type: EventSystem, Text: "JSON protocol enabled, send a login request"})
+	c.startPings()
+}
+
+// WriteEvent sends an event as one line of JSON
+func (c *ClientConn) WriteEvent(ev Event) error {
+	if ev.ID == 0 {
+		id := NewEvent(ev.Type)
+		ev.ID = id.ID
+		if ev.Time.IsZero() {
+			ev.Time = id.Time
+		}
+	}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		chatLogger.Log("error", "Failed to encode event: "+err.Error())
+		return err
+	}
+	_, err = c.send(append(data, '\n'))
+	return err
+}
+
+// jsonLines splits text meant for terminals into the lines sent to JSON
+// clients, it reports whether the text is an error
+func jsonLines(text string) ([]string, bool) {
+	var lines []string
+	for _, line := range strings.Split(stripEscapes(text), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, len(lines) > 0 && strings.HasPrefix(lines[0], "Error")
+}
+
+// writeJSONText turns text meant for terminals into system and error events,
+// while a command runs the text is collected for its response instead. Only
+// the goroutine running the request writes this way, other goroutines send
+// their notices with Notify so they never end up in a response.
+func (c *ClientConn) writeJSONText(text string) {
+	lines, failed := jsonLines(text)
+	if len(lines) == 0 {
+		return
+	}
+
+	c.jsonMu.Lock()
+	if c.request != nil {
+		c.request.lines = append(c.request.lines, lines...)
+		c.request.failed = c.request.failed || failed
+		c.jsonMu.Unlock()
+		return
+	}
+	c.jsonMu.Unlock()
+
+	c.writeJSONLines(lines, failed)
+}
+
+// writeJSONLines sends lines of text as a system or error event
+func (c *ClientConn) writeJSONLines(lines []string, failed bool) {
+	ev := NewEvent(EventSystem)
+	if failed {
+		ev.Type = EventError
+	}
+	ev.Text = strings.Join(lines, "\n")
+	c.WriteEvent(ev)
+}
+
+// beginRequest starts collecting output for the response to a request
+func (c *ClientConn) beginRequest(id string) {
+	c.jsonMu.Lock()
+	defer c.jsonMu.Unlock()
+
+	c.request = &jsonResponse{id: id}
+}
+
+// endRequest sends the response with everything written since beginRequest
+func (c *ClientConn) endRequest() {
+	c.jsonMu.Lock()
+	request := c.request
+	c.request = nil
+	c.jsonMu.Unlock()
+
+	if request == nil {
+		return
+	}
+	ok := !request.failed
+	ev := NewEvent(EventResponse)
+	ev.ReplyTo = request.id
+	ev.OK = &ok
+	ev.Lines = request.lines
+	c.WriteEvent(ev)
+}
+
+// sendResponse answers a request right away
+func (c *ClientConn) sendResponse(id string, ok bool, text string) {
+	ev := NewEvent(EventResponse)
+	ev.ReplyTo = id
+	ev.OK = &ok
+	if text != "" {
+		ev.Lines = []string{text}
+	}
+	c.WriteEvent(ev)
+}
+
+// JSONLoginFunc reads login requests until the client picks a valid name and color
+func JSONLoginFunc(conn *ClientConn, reader *bufio.Reader) (string, string, string) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			chatLogger.Log("error", "Error reading login request: "+err.Error())
+			conn.Close()
+			return "", "", ""
+		}
+
+		var req Request
+		err = json.Unmarshal([]byte(line), &req)
+		if err == nil && req.Type == "pong" {
+			conn.pingAnswered()
+			continue
+		}
+		if err != nil || req.Type != "login" {
+			conn.sendResponse(req.ID, false, `Error: Expected {"type":"login","name":"<name>","color":"<color>"}`)
+			continue
+		}
+
+		// Bots that lost their connection log in with their resume token
+		if req.Resume != "" {
+			if err := ResumeSession(conn, req.Resume); err != nil {
+				conn.sendResponse(req.ID, false, "Error: "+err.Error()+".")
+				continue
+			}
+			conn.sendResponse(req.ID, true, "")
+			return "", "", ""
+		}
+
+		name := strings.TrimSpace(SanitizeName(req.Name))
+		if problem := nameProblem(conn, name); problem != "" {
+			conn.sendResponse(req.ID, false, "Error: "+problem)
+			continue
+		}
+		if IsRegistered(name) {
+			// Addresses that gave too many wrong passwords are locked out for a while
+			ipAddr := remoteIP(conn)
+			if wait := passwordLockedFor(ipAddr); wait > 0 {
+				conn.sendResponse(req.ID, false, fmt.Sprintf("Error: Too many wrong passwords, try again in %v.", wait))
+				conn.Close()
+				return "", "", ""
+			}
+			if !checkPassword(name, req.Password) {
+				chatLogger.Log("connection", "Wrong password for "+name+" from "+conn.RemoteAddr().String())
+				if notePasswordFailure(ipAddr) {
+					conn.sendResponse(req.ID, false, fmt.Sprintf("Error: Too many wrong passwords, try again in %v.", passwordLockedFor(ipAddr)))
+					conn.Close()
+					return "", "", ""
+				}
+				conn.sendResponse(req.ID, false, "Error: Wrong password.")
+				continue
+			}
+			clearPasswordFailures(ipAddr)
+		}
+
+		// Another session of a logged in user keeps the user's color
+		mu.Lock()
+		online := onlineAccount(name) != nil
+		mu.Unlock()
+		if online {
+			conn.sendResponse(req.ID, true, "")
+			return name, "", ""
+		}
+
+		// Take the requested color, the saved one or a free one
+		var userColor, userColorCode string
+		if req.Color != "" {
+			userColor, userColorCode = GetColorByChoice(req.Color)
+			if userColor == "" {
+				conn.sendResponse(req.ID, false, "Error: Invalid color choice.")
+				continue
+			}
+			if colorInUse(conn, userColorCode) {
+				conn.sendResponse(req.ID, false, "Error: Color already in use.")
+				continue
+			}
+		} else if userColor, userColorCode = savedColor(conn, name); userColor == "" {
+			userColor, userColorCode = freeColor(conn)
+		}
+
+		conn.sendResponse(req.ID, true, "")
+		return name, userColor, userColorCode
+	}
+}
+
+// handleJSONRequest runs one request from a JSON client
+func handleJSONRequest(conn *ClientConn, line string) {
+	var req Request
+	if err := json.Unmarshal([]byte(line), &req); err != nil {
+		ev := NewEvent(EventError)
+		ev.Text = "Error: Invalid request: " + err.Error()
+		conn.WriteEvent(ev)
+		return
+	}
+
+	switch req.Type {
+	case "pong":
+		conn.pingAnswered()
+	case "message":
+		text := strings.TrimSpace(SanitizeInput(req.Text))
+		if text == "" {
+			conn.sendResponse(req.ID, false, "Error: Empty message.")
+			return
+		}
+		if len(text) > MaxMessageLength {
+			conn.sendResponse(req.ID, false, "Error: Message too long. Maximum length is "+fmt.Sprint(MaxMessageLength)+" characters.")
+			return
+		}
+
+		mu.Lock()
+		client, exists := Clients[conn]
+		mu.Unlock()
+		if !exists {
+			return
+		}
+		conn.sendResponse(req.ID, true, "")
+		BroadCast(conn, FormatChatMessage(client.name, text), chatEvent(client, text))
+	case "command":
+		command := strings.TrimLeft(strings.TrimSpace(req.Command), "-"+CommandPrefix)
+		if command == "" || strings.ContainsAny(command, " \t") {
+			conn.sendResponse(req.ID, false, "Error: Invalid command.")
+			return
+		}
+		conn.beginRequest(req.ID)
+		Flags(conn, SanitizeInput(strings.Join(append([]string{CommandPrefix + command}, req.Args...), " ")))
+		conn.endRequest()
+	default:
+		conn.sendResponse(req.ID, false, "Error: Unknown request type "+req.Type+".")
+	}
+}
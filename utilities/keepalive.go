@@ -0,0 +1,100 @@
+package utilities
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Telnet option asked for as a ping, clients answer every DO TIMING-MARK, see RFC 860
+const optTimingMark = 6
+
+// checkKeepAlive validates the keepalive and timeout settings
+func checkKeepAlive() error {
+	if ServerConfig.KeepAlive.Duration < 0 || ServerConfig.PingInterval.Duration < 0 ||
+		ServerConfig.DeadPeerTimeout.Duration < 0 || ServerConfig.WriteTimeout.Duration < 0 {
+		return fmt.Errorf("keepalive, ping_interval, dead_peer_timeout and write_timeout must not be negative")
+	}
+	if ServerConfig.PingInterval.Duration > 0 && ServerConfig.DeadPeerTimeout.Duration > 0 &&
+		ServerConfig.DeadPeerTimeout.Duration <= ServerConfig.PingInterval.Duration {
+		return fmt.Errorf("dead_peer_timeout must be longer than ping_interval")
+	}
+	return nil
+}
+
+// setKeepAlive turns on TCP keepalive probes, so the system notices clients
+// that disappeared without closing the connection
+func setKeepAlive(conn net.Conn) {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	period := ServerConfig.KeepAlive.Duration
+	if period <= 0 {
+		tcp.SetKeepAlive(false)
+		return
+	}
+	tcp.SetKeepAliveConfig(net.KeepAliveConfig{Enable: true, Idle: period, Interval: period, Count: 3})
+}
+
+// send writes to the connection, a client that does not take the data within
+// the write timeout is disconnected so it cannot hold up the chat
+func (c *ClientConn) send(p []byte) (int, error) {
+	if timeout := ServerConfig.WriteTimeout.Duration; timeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	n, err := c.Conn.Write(p)
+	if err != nil {
+		c.Conn.Close()
+	}
+	return n, err
+}
+
+// startPings pings telnet and JSON clients every ping interval until the connection is closed
+func (c *ClientConn) startPings() {
+	interval := ServerConfig.PingInterval.Duration
+	c.termMu.Lock()
+	started := c.pinging
+	c.pinging = true
+	c.termMu.Unlock()
+	if started || interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			var err error
+			if c.IsJSON() {
+				err = c.WriteEvent(NewEvent(EventPing))
+			} else {
+				_, err = c.send([]byte{telnetIAC, telnetDO, optTimingMark})
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// pingAnswered notes that the client answers pings, from now on it must
+// not stay silent longer than the dead peer timeout
+func (c *ClientConn) pingAnswered() {
+	c.termMu.Lock()
+	defer c.termMu.Unlock()
+
+	c.answersPings = true
+}
+
+// setReadDeadline makes the next read fail when a client that answers pings stopped answering
+func (c *ClientConn) setReadDeadline() {
+	c.termMu.Lock()
+	answers := c.answersPings
+	c.termMu.Unlock()
+
+	if timeout := ServerConfig.DeadPeerTimeout.Duration; answers && timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+}
@@ -0,0 +1,232 @@
+package utilities
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"unicode/utf8"
+)
+
+// Control keys understood by the line editor
+const (
+	keyCtrlA     = 0x01
+	keyCtrlE     = 0x05
+	keyBackspace = 0x08
+	keyTab       = 0x09
+	keyCtrlL     = 0x0c
+	keyCtrlU     = 0x15
+	keyEscape    = 0x1b
+	keyDelete    = 0x7f
+)
+
+// lineEditor keeps the line a character mode client is typing on the server, so
+// messages arriving in the meantime can be printed above it without breaking it
+type lineEditor struct {
+	buf    []rune // text typed so far
+	cursor int    // position of the cursor in buf
+	prompt string // unfinished last line written to the client, like "[ENTER YOUR NAME]: "
+	masked bool   // the line is a password and shown as stars
+
+	partial  []byte // incomplete UTF-8 sequence
+	escape   []byte // incomplete escape sequence
+	afterCR  bool   // the previous key was a carriage return
+	complete []byte // finished lines waiting to be read
+
+	words      completionWords // candidates for Tab, refreshed before keys are fed
+	completion *completion     // set while repeated Tab presses cycle through candidates
+}
+
+// feed processes keys typed by the client, it returns the echo to send back
+// and moves finished lines to complete
+func (e *lineEditor) feed(input []byte) []byte {
+	var echo bytes.Buffer
+
+	for _, b := range input {
+		if b != keyTab {
+			e.completion = nil
+		}
+
+		if len(e.escape) > 0 {
+			e.escape = append(e.escape, b)
+			if e.handleEscape(&echo) {
+				e.escape = e.escape[:0]
+			}
+			continue
+		}
+
+		// Telnet clients end lines with CR LF or CR NUL
+		if e.afterCR && b == '\n' {
+			e.afterCR = false
+			continue
+		}
+		e.afterCR = b == '\r'
+
+		switch b {
+		case '\r', '\n':
+			line := string(e.buf)
+			if e.prompt != "" {
+				// Keep answers to prompts on screen like a normal terminal does
+				echo.WriteString("\r\n")
+			} else {
+				// Chat lines are cleared, the server sends them back formatted
+				echo.WriteString("\r\033[K")
+			}
+			e.complete = append(e.complete, line+"\n"...)
+			e.buf = e.buf[:0]
+			e.cursor = 0
+			e.prompt = ""
+			e.masked = false
+		case keyBackspace, keyDelete:
+			if e.cursor > 0 {
+				e.buf = append(e.buf[:e.cursor-1], e.buf[e.cursor:]...)
+				e.cursor--
+				echo.WriteString(e.redraw())
+			}
+		case keyCtrlA:
+			e.cursor = 0
+			echo.WriteString(e.redraw())
+		case keyCtrlE:
+			e.cursor = len(e.buf)
+			echo.WriteString(e.redraw())
+		case keyCtrlU:
+			e.buf = e.buf[:0]
+			e.cursor = 0
+			echo.WriteString(e.redraw())
+		case keyCtrlL:
+			echo.WriteString(e.redraw())
+		case keyTab:
+			if e.masked {
+				continue
+			}
+			echo.WriteString(e.completeWord())
+		case keyEscape:
+			e.escape = append(e.escape, b)
+		default:
+			if b < 0x20 {
+				continue
+			}
+			e.partial = append(e.partial, b)
+			if !utf8.FullRune(e.partial) {
+				continue
+			}
+			r, _ := utf8.DecodeRune(e.partial)
+			e.partial = e.partial[:0]
+			if r == utf8.RuneError {
+				continue
+			}
+			e.insert(r)
+			echo.WriteString(e.redraw())
+		}
+	}
+	return echo.Bytes()
+}
+
+// handleEscape applies a cursor key, it reports whether the sequence is finished
+func (e *lineEditor) handleEscape(echo *bytes.Buffer) bool {
+	seq := e.escape
+	if len(seq) < 2 {
+		return false
+	}
+	if seq[1] != '[' && seq[1] != 'O' {
+		return true // not a sequence we know, drop it
+	}
+	if len(seq) < 3 {
+		return false
+	}
+
+	final := seq[len(seq)-1]
+	if final < 0x40 || final > 0x7e {
+		return len(seq) > 8 // still reading parameters
+	}
+
+	switch string(seq[2:]) {
+	case "D": // left
+		if e.cursor > 0 {
+			e.cursor--
+		}
+	case "C": // right
+		if e.cursor < len(e.buf) {
+			e.cursor++
+		}
+	case "H", "1~": // home
+		e.cursor = 0
+	case "F", "4~": // end
+		e.cursor = len(e.buf)
+	case "3~": // delete
+		if e.cursor < len(e.buf) {
+			e.buf = append(e.buf[:e.cursor], e.buf[e.cursor+1:]...)
+		}
+	default:
+		return true
+	}
+	echo.WriteString(e.redraw())
+	return true
+}
+
+// insert adds a rune at the cursor
+func (e *lineEditor) insert(r rune) {
+	e.buf = append(e.buf, 0)
+	copy(e.buf[e.cursor+1:], e.buf[e.cursor:])
+	e.buf[e.cursor] = r
+	e.cursor++
+}
+
+// redraw returns the output that repaints the prompt and the input line
+func (e *lineEditor) redraw() string {
+	shown := string(e.buf)
+	if e.masked {
+		shown = strings.Repeat("*", len(e.buf))
+	}
+	out := "\r\033[K" + e.prompt + shown
+	if back := len(e.buf) - e.cursor; back > 0 {
+		out += fmt.Sprintf("\033[%dD", back)
+	}
+	return out
+}
+
+// output wraps text written to the client so it appears above the input line
+func (e *lineEditor) output(text string) string {
+	// The client's terminal is in raw mode, so every newline needs a carriage return
+	text = strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\n", "\r\n")
+
+	// Text that does not end with a newline ends with a new prompt, unless
+	// the last line only holds escape codes like a color reset
+	lastLine := text[strings.LastIndex(text, "\n")+1:]
+	if escapePattern.ReplaceAllString(lastLine, "") != "" {
+		text = text[:len(text)-len(lastLine)]
+		e.prompt = lastLine
+	}
+	return "\r\033[K" + text + e.redraw()
+}
+
+// MaskInput shows the next line the client types as stars when the line editor is used
+func (c *ClientConn) MaskInput() {
+	c.editMu.Lock()
+	defer c.editMu.Unlock()
+
+	if c.editor != nil {
+		c.editor.masked = true
+	}
+}
+
+// hasLineEditor reports whether the server edits the input line of a client
+func hasLineEditor(conn net.Conn) bool {
+	c, ok := conn.(*ClientConn)
+	if !ok {
+		return false
+	}
+	c.editMu.Lock()
+	defer c.editMu.Unlock()
+
+	return c.editor != nil
+}
+
+// ClearInputLine removes the line a client just sent from its screen. Clients that
+// echo locally need the cursor moved up, the line editor already cleared it.
+func ClearInputLine(conn net.Conn) {
+	if hasLineEditor(conn) {
+		return
+	}
+	conn.Write([]byte("\033[A\033[2K"))
+}
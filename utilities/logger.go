@@ -37,10 +37,6 @@ func (l *Logger) Log(logType string, message string) {
 	case "connection":
 		prefix = "CONNECTION: "
 	case "chat":
-		// Remove timestamp from chat messages as it's already added by the logger
-		if len(message) > 21 && message[0] == '[' {
-			message = message[21:]
-		}
 		prefix = "CHAT: "
 	case "chat - DM":
 		prefix = "CHAT - DM: "
@@ -2,47 +2,36 @@ package utilities
 
 import (
 	"bufio"
+	"fmt"
 	"net"
+	"strconv"
 	"strings"
 )
 
-func ColorLoginFunc(conn net.Conn, reader *bufio.Reader, name string) (string, string) {
+// ColorLoginFunc asks a new user for their color until they pick a free one
+func ColorLoginFunc(conn net.Conn, reader *bufio.Reader) (string, string) {
 	for {
-
-		for connection := range Clients {
-			if connection != conn {
-				if Clients[connection].name == name {
-					NameLoginFunc(conn, reader)
-					continue
-				}
-			}
-		}
-
-		conn.Write([]byte(ColorMenu))
+		available := availableColors(conn)
+		PrintColorMenu(conn, available)
 		colorChoice, err := reader.ReadString('\n')
 		if err != nil {
 			conn.Close()
 			return "", ""
 		}
+
+		// Users who skip the question get a free color
 		colorChoice = strings.TrimSpace(colorChoice)
-		userColor, userColorCode := GetColorByChoice(colorChoice)
+		if colorChoice == "" {
+			return freeColor(conn)
+		}
+
+		userColor, userColorCode := GetColorByChoice(menuChoice(available, colorChoice))
 		if userColor == "" {
 			conn.Write([]byte("Invalid color choice, try again.\n"))
 			continue
 		}
 
-		// Check color availability with a quick lock
-		mu.Lock()
-		colorExists := false
-		for _, info := range Clients {
-			if info.color == userColor {
-				colorExists = true
-				break
-			}
-		}
-		mu.Unlock()
-
-		if colorExists {
+		if colorInUse(conn, userColorCode) {
 			conn.Write([]byte("Color already in use, choose a different color.\n"))
 			continue
 		}
@@ -61,28 +50,90 @@ func NameLoginFunc(conn net.Conn, reader *bufio.Reader) string {
 			return ""
 		}
 
-		name := strings.TrimSpace(nameInput)
-		if name == "" || len(name) > 20 {
-			conn.Write([]byte("Name cannot be empty or more than 20 characters.\n"))
-			continue
+		// Bots can switch to the JSON protocol instead of sending a name
+		if c, ok := conn.(*ClientConn); ok && isJSONHandshake(nameInput) {
+			c.SetJSON()
+			return ""
 		}
 
-		// Check name availability with a quick lock
-		mu.Lock()
-		nameExists := false
-		for _, info := range Clients {
-			if info.name == name {
-				nameExists = true
-				break
+		// Users who lost their connection come back with their resume token
+		if token, found := strings.CutPrefix(strings.TrimSpace(nameInput), CommandPrefix+"resume"); found {
+			if c, ok := conn.(*ClientConn); ok {
+				if err := ResumeSession(c, token); err != nil {
+					conn.Write([]byte(FormatErrorMessage("Error: "+err.Error()+".") + "\n"))
+					continue
+				}
+				return ""
 			}
 		}
-		mu.Unlock()
 
-		if nameExists {
-			conn.Write([]byte("Username already exists, choose a different name.\n"))
+		name := strings.TrimSpace(SanitizeName(nameInput))
+		if problem := nameProblem(conn, name); problem != "" {
+			conn.Write([]byte(problem + "\n"))
 			continue
 		}
 
+		// Registered names need their password, the connection is closed after too many wrong ones
+		if IsRegistered(name) && !PasswordLoginFunc(conn, reader, name) {
+			conn.Close()
+			return ""
+		}
+
 		return name
 	}
 }
+
+// PasswordLoginFunc asks for the password of a registered name, it reports
+// whether the right password was given before the address got locked out
+func PasswordLoginFunc(conn net.Conn, reader *bufio.Reader, name string) bool {
+	ipAddr := remoteIP(conn)
+	if wait := passwordLockedFor(ipAddr); wait > 0 {
+		conn.Write([]byte(fmt.Sprintf("Too many wrong passwords, try again in %v.\n", wait)))
+		return false
+	}
+
+	for {
+		if c, ok := conn.(*ClientConn); ok {
+			c.MaskInput()
+		}
+		conn.Write([]byte("[ENTER YOUR PASSWORD]: "))
+		password, err := reader.ReadString('\n')
+		if err != nil {
+			return false
+		}
+		if checkPassword(name, strings.TrimRight(password, "\r\n")) {
+			clearPasswordFailures(ipAddr)
+			return true
+		}
+
+		chatLogger.Log("connection", "Wrong password for "+name+" from "+conn.RemoteAddr().String())
+		if notePasswordFailure(ipAddr) {
+			conn.Write([]byte(fmt.Sprintf("Too many wrong passwords, try again in %v.\n", passwordLockedFor(ipAddr))))
+			return false
+		}
+		conn.Write([]byte("Wrong password.\n"))
+	}
+}
+
+// menuChoice turns a number from a menu of the given colors into the color's
+// name, anything else is returned unchanged
+func menuChoice(colors []PaletteColor, choice string) string {
+	if n, err := strconv.Atoi(choice); err == nil && n >= 1 && n <= len(colors) {
+		return colors[n-1].Name
+	}
+	return choice
+}
+
+// colorInUse reports whether another client already has the color, or one that
+// looks the same on a 256 color terminal
+func colorInUse(conn net.Conn, colorCode string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for c, info := range Clients {
+		if c != conn && sameColor(info.colorCode, colorCode) {
+			return true
+		}
+	}
+	return false
+}
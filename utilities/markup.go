@@ -0,0 +1,125 @@
+package utilities
+
+import (
+	"html"
+	"strings"
+	"unicode"
+)
+
+// markupStyle is one kind of inline markup, like *bold*
+type markupStyle struct {
+	delim    rune
+	ansiOn   string
+	ansiOff  string
+	htmlTag  string
+	verbatim bool // the content is shown as typed, without markup inside
+}
+
+// Inline markup understood in chat messages
+var markupStyles = []markupStyle{
+	{delim: '`', ansiOn: "\033[7m", ansiOff: "\033[27m", htmlTag: "code", verbatim: true},
+	{delim: '*', ansiOn: "\033[1m", ansiOff: "\033[22m", htmlTag: "strong"},
+	{delim: '_', ansiOn: "\033[3m", ansiOff: "\033[23m", htmlTag: "em"},
+	{delim: '~', ansiOn: "\033[9m", ansiOff: "\033[29m", htmlTag: "del"},
+}
+
+// MarkupToANSI turns the markup of a message into terminal formatting, plain
+// mode clients lose the formatting again when the output is rendered
+func MarkupToANSI(text string) string {
+	return renderMarkup(text,
+		func(style markupStyle) string { return style.ansiOn },
+		func(style markupStyle) string { return style.ansiOff },
+		plainText)
+}
+
+// MarkupToHTML turns the markup of a message into HTML for web clients
+func MarkupToHTML(text string) string {
+	return renderMarkup(escapePattern.ReplaceAllString(text, ""),
+		func(style markupStyle) string { return "<" + style.htmlTag + ">" },
+		func(style markupStyle) string { return "</" + style.htmlTag + ">" },
+		html.EscapeString)
+}
+
+// renderMarkup replaces every marked up span of text with the output of open
+// and close, everything else is passed through escape
+func renderMarkup(text string, open, close func(markupStyle) string, escape func(string) string) string {
+	runes := []rune(text)
+	var out strings.Builder
+	plainStart := 0
+
+	for i := 0; i < len(runes); i++ {
+		style, found := markupStyleFor(runes[i])
+		if !found || !opensMarkup(runes, i) {
+			continue
+		}
+		end := closingMarkup(runes, i, style.delim)
+		if end < 0 {
+			continue
+		}
+
+		out.WriteString(escape(string(runes[plainStart:i])))
+		inner := string(runes[i+1 : end])
+		if style.verbatim {
+			out.WriteString(open(style) + escape(inner) + close(style))
+		} else {
+			out.WriteString(open(style) + renderMarkup(inner, open, close, escape) + close(style))
+		}
+		i = end
+		plainStart = end + 1
+	}
+	out.WriteString(escape(string(runes[plainStart:])))
+	return out.String()
+}
+
+// markupStyleFor returns the style a delimiter starts
+func markupStyleFor(r rune) (markupStyle, bool) {
+	for _, style := range markupStyles {
+		if style.delim == r {
+			return style, true
+		}
+	}
+	return markupStyle{}, false
+}
+
+// opensMarkup reports whether the delimiter at i can start a span, it must not
+// be inside a word and must be followed by text, so 2*3*4 and snake_case stay as typed
+func opensMarkup(runes []rune, i int) bool {
+	if i > 0 && isWordRune(runes[i-1]) {
+		return false
+	}
+	return i+1 < len(runes) && !unicode.IsSpace(runes[i+1]) && runes[i+1] != runes[i]
+}
+
+// closingMarkup returns the index of the delimiter that closes the span opened at start, -1 if there is none
+func closingMarkup(runes []rune, start int, delim rune) int {
+	for j := start + 2; j < len(runes); j++ {
+		if runes[j] != delim || unicode.IsSpace(runes[j-1]) {
+			continue
+		}
+		if j+1 < len(runes) && isWordRune(runes[j+1]) {
+			continue
+		}
+		return j
+	}
+	return -1
+}
+
+// isWordRune reports whether a rune is part of a word
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// withMarkup renders the markup in the body at the end of a formatted line,
+// the timestamp and the name in front of it are only passed through escape
+func withMarkup(line, body string, render, escape func(string) string) string {
+	trimmed := strings.TrimRight(line, "\n")
+	if body == "" || !strings.HasSuffix(trimmed, body) {
+		return escape(line)
+	}
+	return escape(trimmed[:len(trimmed)-len(body)]) + render(body) + escape(line[len(trimmed):])
+}
+
+// plainText passes text through unchanged
+func plainText(text string) string {
+	return text
+}
@@ -0,0 +1,177 @@
+package utilities
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// File used to keep queued direct messages between server restarts
+	OfflineStoreFile = "offline_messages.json"
+
+	// Maximum number of queued direct messages per recipient
+	MaxOfflineMessages = 20
+)
+
+// OfflineMessage is a direct message waiting for its receiver to log in
+type OfflineMessage struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Group     []string  `json:"group,omitempty"`
+	Color     string    `json:"color"`
+	ColorCode string    `json:"color_code"`
+	Text      string    `json:"text"`
+	SentAt    time.Time `json:"sent_at"`
+}
+
+// offlineStore is the on-disk layout of the offline message file
+type offlineStore struct {
+	Known []string                    `json:"known_users"`
+	Queue map[string][]OfflineMessage `json:"queue"`
+}
+
+var (
+	// Mutex for protecting the known users and the offline queue
+	offlineMu sync.Mutex
+
+	// Names that have logged in at least once, by NameKey
+	knownUsers = make(map[string]string)
+
+	// Queued direct messages by the NameKey of the receiver
+	offlineQueue = make(map[string][]OfflineMessage)
+)
+
+// InitOfflineMessages loads the known users and queued messages from disk
+func InitOfflineMessages() error {
+	offlineMu.Lock()
+	defer offlineMu.Unlock()
+
+	data, err := os.ReadFile(OfflineStoreFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading offline messages: %v", err)
+	}
+
+	var store offlineStore
+	if err := json.Unmarshal(data, &store); err != nil {
+		return fmt.Errorf("error parsing offline messages: %v", err)
+	}
+
+	for _, name := range store.Known {
+		knownUsers[NameKey(name)] = name
+	}
+	// Guests left when the server stopped, only messages for accounts are kept
+	for name, msgs := range store.Queue {
+		if IsRegistered(name) {
+			offlineQueue[NameKey(name)] = append(offlineQueue[NameKey(name)], msgs...)
+		}
+	}
+	return nil
+}
+
+// saveOfflineStore writes the offline state to disk, offlineMu must be held
+func saveOfflineStore() {
+	store := offlineStore{Queue: offlineQueue}
+	for _, name := range knownUsers {
+		store.Known = append(store.Known, name)
+	}
+
+	data, err := json.MarshalIndent(store, "", "  ")
+	if err != nil {
+		chatLogger.Log("error", "Failed to encode offline messages: "+err.Error())
+		return
+	}
+	if err := os.WriteFile(OfflineStoreFile, data, 0666); err != nil {
+		chatLogger.Log("error", "Failed to save offline messages: "+err.Error())
+	}
+}
+
+// MarkKnownUser remembers a name so direct messages can be queued for it later,
+// the last spelling a user logged in with is kept
+func MarkKnownUser(name string) {
+	offlineMu.Lock()
+	defer offlineMu.Unlock()
+
+	if knownUsers[NameKey(name)] == name {
+		return
+	}
+	knownUsers[NameKey(name)] = name
+	saveOfflineStore()
+}
+
+// KnownUserName returns how a user who has logged in before spells their name
+func KnownUserName(name string) (string, bool) {
+	offlineMu.Lock()
+	defer offlineMu.Unlock()
+
+	known, exists := knownUsers[NameKey(name)]
+	return known, exists
+}
+
+// QueueOfflineMessage stores a direct message for a user who is not connected
+func QueueOfflineMessage(msg OfflineMessage) error {
+	offlineMu.Lock()
+	defer offlineMu.Unlock()
+
+	key := NameKey(msg.To)
+	if len(offlineQueue[key]) >= MaxOfflineMessages {
+		return fmt.Errorf("%s has too many unread messages, try again later", msg.To)
+	}
+
+	offlineQueue[key] = append(offlineQueue[key], msg)
+	saveOfflineStore()
+	return nil
+}
+
+// dropOfflineMessages deletes the messages queued for a guest who left, the
+// file is written in the background since callers hold mu
+func dropOfflineMessages(name string) {
+	offlineMu.Lock()
+	defer offlineMu.Unlock()
+
+	if _, queued := offlineQueue[NameKey(name)]; !queued {
+		return
+	}
+	delete(offlineQueue, NameKey(name))
+	go func() {
+		offlineMu.Lock()
+		defer offlineMu.Unlock()
+
+		saveOfflineStore()
+	}()
+}
+
+// DeliverOfflineMessages sends queued direct messages to a user who just logged in
+func DeliverOfflineMessages(conn net.Conn, name string) {
+	offlineMu.Lock()
+	msgs := offlineQueue[NameKey(name)]
+	if len(msgs) > 0 {
+		delete(offlineQueue, NameKey(name))
+		saveOfflineStore()
+	}
+	offlineMu.Unlock()
+
+	if len(msgs) == 0 {
+		return
+	}
+
+	conn.Write([]byte(fmt.Sprintf("You have %d message(s) received while you were offline:\n", len(msgs))))
+	for _, msg := range msgs {
+		receivers := msg.Group
+		if len(receivers) == 0 {
+			receivers = []string{msg.To}
+		}
+		ev := dmEvent(msg.From, msg.ColorCode, receivers, msg.Text, msg.SentAt)
+		SendEvent(conn, ev, msg.Color+stamp(conn, msg.SentAt)+FormatPrivateMessage(msg.From, receivers, msg.Text, false)+Reset)
+		SetLastConversation(name, append([]string{msg.From}, receivers...))
+	}
+	conn.Write([]byte("\n"))
+
+	chatLogger.Log("chat - DM", fmt.Sprintf("Delivered %d offline message(s) to %s", len(msgs), name))
+}
@@ -0,0 +1,251 @@
+package utilities
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// File where deliveries that failed every attempt are written
+	DeadLetterFile = "webhook_dead_letters.log"
+
+	// Event type sent when a message mentions a keyword or a user
+	EventMention = "mention"
+
+	// Number of deliveries waiting to be sent to one webhook before new ones are dead-lettered
+	webhookQueueSize = 100
+)
+
+// OutgoingWebhook is an external URL notified about chat events
+type OutgoingWebhook struct {
+	URL      string   `json:"url"`
+	Events   []string `json:"events"`   // event types to send, like message, join, leave or mention
+	Pattern  string   `json:"pattern"`  // messages are only sent if they match this regular expression
+	Keywords []string `json:"keywords"` // words that count as a mention, any @name when empty
+
+	pattern *regexp.Regexp
+	queue   chan webhookDelivery // deliveries waiting for the webhook's sender
+}
+
+// webhookDelivery is one event on its way to one webhook
+type webhookDelivery struct {
+	webhook *OutgoingWebhook
+	event   Event
+}
+
+// deadLetter is the line written for a delivery that could not be sent
+type deadLetter struct {
+	Time     time.Time `json:"time"`
+	URL      string    `json:"url"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	Event    Event     `json:"event"`
+}
+
+var (
+	// Client used for all outgoing webhook requests
+	webhookClient = &http.Client{Timeout: 5 * time.Second}
+
+	// Matches @name mentions in messages
+	mentionPattern = regexp.MustCompile(`@(\S+)`)
+)
+
+// Event types an outgoing webhook can subscribe to
+var webhookEventTypes = map[string]bool{
+	EventMessage: true,
+	EventJoin:    true,
+	EventLeave:   true,
+	EventRename:  true,
+	EventColor:   true,
+	EventMention: true,
+}
+
+// checkOutgoingWebhooks validates the configured webhooks and compiles their patterns
+func checkOutgoingWebhooks(webhooks []OutgoingWebhook) error {
+	for i := range webhooks {
+		webhook := &webhooks[i]
+		if !strings.HasPrefix(webhook.URL, "http://") && !strings.HasPrefix(webhook.URL, "https://") {
+			return fmt.Errorf("outgoing webhook %d needs an http or https url", i+1)
+		}
+		if len(webhook.Events) == 0 {
+			return fmt.Errorf("outgoing webhook %s has no events", webhook.URL)
+		}
+		for _, eventType := range webhook.Events {
+			if !webhookEventTypes[eventType] {
+				return fmt.Errorf("outgoing webhook %s uses unknown event %s", webhook.URL, eventType)
+			}
+		}
+		if webhook.Pattern != "" {
+			pattern, err := regexp.Compile(webhook.Pattern)
+			if err != nil {
+				return fmt.Errorf("outgoing webhook %s has an invalid pattern: %v", webhook.URL, err)
+			}
+			webhook.pattern = pattern
+		}
+		webhook.queue = make(chan webhookDelivery, webhookQueueSize)
+	}
+	return nil
+}
+
+// subscribes reports whether the webhook wants events of the given type
+func (w *OutgoingWebhook) subscribes(eventType string) bool {
+	for _, t := range w.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// mentions returns what a message mentions for this webhook, nil if nothing
+func (w *OutgoingWebhook) mentions(text string) []string {
+	if len(w.Keywords) == 0 {
+		return parseMentions(text)
+	}
+
+	var found []string
+
+	lower := strings.ToLower(text)
+	for _, keyword := range w.Keywords {
+		if strings.Contains(lower, strings.ToLower(keyword)) {
+			found = append(found, keyword)
+		}
+	}
+	return found
+}
+
+// parseMentions returns the names mentioned with @name in a message, spelled
+// like the users spell them when they are known
+func parseMentions(text string) []string {
+	var names []string
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		name := strings.TrimRight(match[1], ".,:;!?")
+		if nameSyntaxProblem(name) != "" {
+			continue
+		}
+		if known, exists := KnownUserName(name); exists {
+			name = known
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// PublishEvent queues an event for every outgoing webhook interested in it, it never blocks
+func PublishEvent(ev Event) {
+	for i := range ServerConfig.OutgoingWebhooks {
+		webhook := &ServerConfig.OutgoingWebhooks[i]
+
+		if webhook.subscribes(ev.Type) {
+			if ev.Type != EventMessage || webhook.pattern == nil || webhook.pattern.MatchString(ev.Text) {
+				queueDelivery(webhook, ev)
+			}
+		}
+
+		if ev.Type == EventMessage && webhook.subscribes(EventMention) {
+			if found := webhook.mentions(ev.Text); len(found) > 0 {
+				mention := ev
+				mention.Type = EventMention
+				mention.Mentions = found
+				queueDelivery(webhook, mention)
+			}
+		}
+	}
+}
+
+// queueDelivery hands a delivery to the webhook's sender, or dead-letters it when the queue is full
+func queueDelivery(webhook *OutgoingWebhook, ev Event) {
+	select {
+	case webhook.queue <- webhookDelivery{webhook: webhook, event: ev}:
+	default:
+		writeDeadLetter(webhook, ev, 0, "queue full")
+	}
+}
+
+// StartWebhookSender starts one sender goroutine per webhook, each delivers its
+// events in order, so a failing webhook only fills up its own queue and does
+// not hold up the others
+func StartWebhookSender() {
+	for i := range ServerConfig.OutgoingWebhooks {
+		webhook := &ServerConfig.OutgoingWebhooks[i]
+		go func() {
+			for delivery := range webhook.queue {
+				deliver(delivery)
+			}
+		}()
+	}
+}
+
+// deliver posts an event to a webhook, retrying with a growing delay
+func deliver(delivery webhookDelivery) {
+	body, err := json.Marshal(delivery.event)
+	if err != nil {
+		writeDeadLetter(delivery.webhook, delivery.event, 0, err.Error())
+		return
+	}
+
+	backoff := ServerConfig.WebhookBackoff.Duration
+	attempts := ServerConfig.WebhookRetries + 1
+	for attempt := 1; attempt <= attempts; attempt++ {
+		err = postEvent(delivery.webhook.URL, delivery.event.Type, body)
+		if err == nil {
+			return
+		}
+		chatLogger.Log("error", fmt.Sprintf("Webhook %s failed (attempt %d of %d): %v", delivery.webhook.URL, attempt, attempts, err))
+
+		if attempt < attempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	writeDeadLetter(delivery.webhook, delivery.event, attempts, err.Error())
+}
+
+// postEvent sends one event and treats every status outside 2xx as an error
+func postEvent(url, eventType string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Chat-Event", eventType)
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// writeDeadLetter keeps a delivery that could not be sent so it can be replayed by hand
+func writeDeadLetter(webhook *OutgoingWebhook, ev Event, attempts int, reason string) {
+	data, err := json.Marshal(deadLetter{
+		Time:     time.Now().UTC(),
+		URL:      webhook.URL,
+		Attempts: attempts,
+		Error:    reason,
+		Event:    ev,
+	})
+	if err != nil {
+		return
+	}
+
+	file, err := os.OpenFile(DeadLetterFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		chatLogger.Log("error", "Failed to open dead letter file: "+err.Error())
+		return
+	}
+	defer file.Close()
+	file.Write(append(data, '\n'))
+}
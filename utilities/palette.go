@@ -0,0 +1,166 @@
+package utilities
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// PaletteColor is a color users can pick, Color is a 256 color number like
+// "208" or a true color like "#ff8800"
+type PaletteColor struct {
+	Name  string `json:"name"`
+	Color string `json:"color"`
+
+	escape string
+}
+
+// Colors offered when the config has no palette
+var defaultPalette = []PaletteColor{
+	{Name: "red", escape: Red},
+	{Name: "green", escape: Green},
+	{Name: "yellow", escape: Yellow},
+	{Name: "blue", escape: Blue},
+	{Name: "pink", escape: Pink},
+	{Name: "cyan", escape: Cyan},
+	{Name: "purple", escape: Purple},
+	{Name: "orange", escape: Orange},
+	{Name: "teal", escape: Teal},
+	{Name: "lime", escape: Lime},
+}
+
+// Matches true colors like #ff8800
+var hexColorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// colorEscape returns the escape code that shows a 256 color number or a #rrggbb color
+func colorEscape(color string) (string, error) {
+	if hexColorPattern.MatchString(color) {
+		r, _ := strconv.ParseUint(color[1:3], 16, 8)
+		g, _ := strconv.ParseUint(color[3:5], 16, 8)
+		b, _ := strconv.ParseUint(color[5:7], 16, 8)
+		return fmt.Sprintf("\033[38;2;%d;%d;%dm", r, g, b), nil
+	}
+	n, err := strconv.Atoi(color)
+	if err != nil || n < 0 || n > 255 {
+		return "", fmt.Errorf("color %q must be a number from 0 to 255 or #rrggbb", color)
+	}
+	return fmt.Sprintf("\033[38;5;%dm", n), nil
+}
+
+// checkPalette validates the configured palette and prepares its escape codes
+func checkPalette(palette []PaletteColor) error {
+	names := make(map[string]bool)
+	for i := range palette {
+		color := &palette[i]
+		color.Name = strings.ToLower(strings.TrimSpace(color.Name))
+		if color.Name == "" || strings.ContainsAny(color.Name, " \t") || hexColorPattern.MatchString(color.Name) {
+			return fmt.Errorf("palette color %d needs a name without spaces", i+1)
+		}
+		if _, err := strconv.Atoi(color.Name); err == nil {
+			return fmt.Errorf("palette color %s cannot be named with a number", color.Name)
+		}
+		if names[color.Name] {
+			return fmt.Errorf("palette color %s is configured twice", color.Name)
+		}
+		names[color.Name] = true
+
+		escape, err := colorEscape(color.Color)
+		if err != nil {
+			return fmt.Errorf("palette color %s: %v", color.Name, err)
+		}
+		color.escape = escape
+	}
+	return nil
+}
+
+// palette returns the colors users can pick from
+func palette() []PaletteColor {
+	if len(ServerConfig.Palette) > 0 {
+		return ServerConfig.Palette
+	}
+	return defaultPalette
+}
+
+// GetColorByChoice returns the escape code and the color code of a palette
+// number, a palette color name or a #rrggbb color, or empty strings if the choice is invalid
+func GetColorByChoice(choice string) (string, string) {
+	colors := palette()
+	choice = strings.ToLower(strings.TrimSpace(choice))
+
+	if n, err := strconv.Atoi(choice); err == nil {
+		if n < 1 || n > len(colors) {
+			return "", ""
+		}
+		return colors[n-1].escape, colors[n-1].Name
+	}
+	for _, color := range colors {
+		if color.Name == choice {
+			return color.escape, color.Name
+		}
+	}
+	if hexColorPattern.MatchString(choice) {
+		escape, _ := colorEscape(choice)
+		return escape, choice
+	}
+	return "", ""
+}
+
+// colorName returns the name of a color code, codes saved before the palette
+// was configurable are palette numbers
+func colorName(colorCode string) string {
+	if n, err := strconv.Atoi(colorCode); err == nil {
+		if colors := palette(); n >= 1 && n <= len(colors) {
+			return colors[n-1].Name
+		}
+		return ""
+	}
+	return colorCode
+}
+
+// sameColor reports whether two color codes look the same, true colors are
+// compared by the palette color a 256 color terminal shows them with
+func sameColor(code1, code2 string) bool {
+	if code1 == code2 {
+		return true
+	}
+	escape1, _ := GetColorByChoice(colorName(code1))
+	escape2, _ := GetColorByChoice(colorName(code2))
+	return escape1 != "" && Render(escape1, Mode256Color) == Render(escape2, Mode256Color)
+}
+
+// availableColors returns the palette colors nobody else uses
+func availableColors(conn net.Conn) []PaletteColor {
+	var available []PaletteColor
+	for _, color := range palette() {
+		if !colorInUse(conn, color.Name) {
+			available = append(available, color)
+		}
+	}
+	return available
+}
+
+// freeColor returns the first palette color nobody uses, once the palette is
+// used up a color from the 256 color cube is generated instead
+func freeColor(conn net.Conn) (string, string) {
+	if available := availableColors(conn); len(available) > 0 {
+		return available[0].escape, available[0].Name
+	}
+
+	// Walk the 6x6x6 cube in big steps so users joining one after another get
+	// different looking colors, and skip the ones too dark to read
+	for i := 0; i < 216; i++ {
+		n := i * 47 % 216
+		r, g, b := n/36, n/6%6, n%6
+		if r+g+b < 5 {
+			continue
+		}
+		code := fmt.Sprintf("#%02x%02x%02x", cubeLevels[r], cubeLevels[g], cubeLevels[b])
+		if !colorInUse(conn, code) {
+			escape, _ := colorEscape(code)
+			return escape, code
+		}
+	}
+	return "", ""
+}
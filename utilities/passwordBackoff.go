@@ -0,0 +1,82 @@
+package utilities
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Lockout after MaxPasswordAttempts wrong passwords from an address, it
+	// doubles with every lockout in a row up to MaxPasswordLockout
+	PasswordLockout    = 30 * time.Second
+	MaxPasswordLockout = 15 * time.Minute
+)
+
+// passwordFailures counts the wrong passwords given from one address
+type passwordFailures struct {
+	count       int // wrong passwords since the last lockout
+	lockouts    int // lockouts in a row, reset by a right password
+	lockedUntil time.Time
+}
+
+var (
+	// Mutex for protecting the password failures
+	failuresMu sync.Mutex
+
+	// Wrong account and operator passwords by IP address
+	failedPasswords = make(map[string]*passwordFailures)
+)
+
+// remoteIP returns the IP address a connection comes from
+func remoteIP(conn net.Conn) string {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return conn.RemoteAddr().String()
+}
+
+// passwordLockedFor returns how long an address must wait before it may try a password again
+func passwordLockedFor(ipAddr string) time.Duration {
+	failuresMu.Lock()
+	defer failuresMu.Unlock()
+
+	if f := failedPasswords[ipAddr]; f != nil {
+		if wait := time.Until(f.lockedUntil); wait > 0 {
+			return wait.Round(time.Second)
+		}
+	}
+	return 0
+}
+
+// notePasswordFailure counts a wrong password, it reports whether the address is now locked out
+func notePasswordFailure(ipAddr string) bool {
+	failuresMu.Lock()
+	defer failuresMu.Unlock()
+
+	f := failedPasswords[ipAddr]
+	if f == nil {
+		f = &passwordFailures{}
+		failedPasswords[ipAddr] = f
+	}
+	if f.count++; f.count < MaxPasswordAttempts {
+		return false
+	}
+
+	lockout := PasswordLockout << f.lockouts
+	if lockout <= 0 || lockout > MaxPasswordLockout {
+		lockout = MaxPasswordLockout
+	}
+	f.count = 0
+	f.lockouts++
+	f.lockedUntil = time.Now().Add(lockout)
+	return true
+}
+
+// clearPasswordFailures forgets the wrong passwords of an address after a right one
+func clearPasswordFailures(ipAddr string) {
+	failuresMu.Lock()
+	defer failuresMu.Unlock()
+
+	delete(failedPasswords, ipAddr)
+}
@@ -0,0 +1,315 @@
+package utilities
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // timezones work on systems without a zoneinfo database
+)
+
+// Layout of the timestamps in messages
+const TimestampLayout = "2006-01-02 15:04:05"
+
+// Preferences are the display settings a user changes with /set, they are
+// saved for registered users and applied when they log in
+type Preferences struct {
+	Color       string `json:"color,omitempty"`
+	TimeFormat  string `json:"time_format,omitempty"`
+	Timezone    string `json:"timezone,omitempty"`
+	HideJoins   bool   `json:"hide_joins,omitempty"`
+	HidePenguin bool   `json:"hide_penguin,omitempty"`
+	History     *int   `json:"history,omitempty"`
+}
+
+// Timestamp formats users can choose with /set timeformat
+var timeFormats = map[string]string{
+	"full":  TimestampLayout,
+	"time":  "15:04:05",
+	"short": "15:04",
+	"12h":   "3:04:05 PM",
+}
+
+// preference is one setting of /set
+type preference struct {
+	key    string
+	values string // shown in the usage
+	show   func(prefs Preferences) string
+	set    func(prefs *Preferences, value string) error
+}
+
+// Settings of /set in the order they are listed
+var preferences = []preference{
+	{
+		key:    "color",
+		values: "<name or #rrggbb>",
+		show:   func(prefs Preferences) string { return orDefault(colorName(prefs.Color), "not saved") },
+	},
+	{
+		key:    "timeformat",
+		values: "<full|time|short|12h>",
+		show:   func(prefs Preferences) string { return orDefault(prefs.TimeFormat, "full") },
+		set: func(prefs *Preferences, value string) error {
+			if timeFormats[value] == "" {
+				return fmt.Errorf("timeformat must be one of full, time, short or 12h")
+			}
+			prefs.TimeFormat = value
+			return nil
+		},
+	},
+	{
+		key:    "timezone",
+		values: "<Area/City|UTC|server>",
+		show:   func(prefs Preferences) string { return orDefault(prefs.Timezone, "server") },
+		set: func(prefs *Preferences, value string) error {
+			if value == "server" {
+				prefs.Timezone = ""
+				return nil
+			}
+			if _, err := time.LoadLocation(value); err != nil || value == "" || value == "Local" {
+				return fmt.Errorf("unknown timezone %s, use a name like Europe/Athens", value)
+			}
+			prefs.Timezone = value
+			return nil
+		},
+	},
+	{
+		key:    "joins",
+		values: "<on|off>",
+		show:   func(prefs Preferences) string { return onOff(!prefs.HideJoins) },
+		set: func(prefs *Preferences, value string) error {
+			on, err := parseOnOff(value)
+			prefs.HideJoins = !on
+			return err
+		},
+	},
+	{
+		key:    "penguin",
+		values: "<on|off>",
+		show:   func(prefs Preferences) string { return onOff(!prefs.HidePenguin) },
+		set: func(prefs *Preferences, value string) error {
+			on, err := parseOnOff(value)
+			prefs.HidePenguin = !on
+			return err
+		},
+	},
+	{
+		key:    "history",
+		values: fmt.Sprintf("<0-%d>", MaxHistorySize),
+		show:   func(prefs Preferences) string { return fmt.Sprint(prefs.historyCount()) },
+		set: func(prefs *Preferences, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 || n > MaxHistorySize {
+				return fmt.Errorf("history must be a number from 0 to %d", MaxHistorySize)
+			}
+			prefs.History = &n
+			return nil
+		},
+	},
+}
+
+// historyCount returns how many history messages are replayed at login
+func (prefs Preferences) historyCount() int {
+	if prefs.History == nil {
+		return MaxHistorySize
+	}
+	return *prefs.History
+}
+
+// location returns the timezone timestamps are shown in
+func (prefs Preferences) location() *time.Location {
+	if prefs.Timezone == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(prefs.Timezone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// orDefault returns value, or def when value is empty
+func orDefault(value, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+// onOff shows a boolean setting
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// parseOnOff reads a boolean setting
+func parseOnOff(value string) (bool, error) {
+	switch value {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("the value must be on or off")
+}
+
+// ShowPreferences lists the user's settings
+func ShowPreferences(conn net.Conn) {
+	mu.Lock()
+	client, exists := Clients[conn]
+	if !exists {
+		mu.Unlock()
+		return
+	}
+	prefs := client.prefs
+	account := client.account
+	mu.Unlock()
+
+	list := "\nYour settings:\n"
+	for _, pref := range preferences {
+		list += fmt.Sprintf("  %-11s %-12s /set %s %s\n", pref.key, pref.show(prefs), pref.key, pref.values)
+	}
+	if !account {
+		list += "Settings are kept until you leave, use /register to save them.\n"
+	}
+	conn.Write([]byte(list + "\n"))
+}
+
+// SetPreference changes one setting and saves it when the user is registered
+func SetPreference(conn net.Conn, key, value string) {
+	var pref *preference
+	for i := range preferences {
+		if preferences[i].key == key {
+			pref = &preferences[i]
+		}
+	}
+	if pref == nil {
+		keys := make([]string, len(preferences))
+		for i, p := range preferences {
+			keys[i] = p.key
+		}
+		conn.Write([]byte(FormatErrorMessage("\nError: Unknown setting "+key+", use one of "+strings.Join(keys, ", ")+".") + "\n"))
+		return
+	}
+
+	mu.Lock()
+	client, exists := Clients[conn]
+	if !exists {
+		mu.Unlock()
+		return
+	}
+	prefs := client.prefs
+	mu.Unlock()
+
+	if pref.key == "color" {
+		// Changing the color is announced like /color
+		if SetColor(conn, value) != nil {
+			return
+		}
+		mu.Lock()
+		prefs.Color = client.colorCode
+		mu.Unlock()
+	} else if err := pref.set(&prefs, value); err != nil {
+		conn.Write([]byte(FormatErrorMessage("\nError: "+err.Error()+".") + "\n"))
+		return
+	}
+
+	mu.Lock()
+	client.prefs = prefs
+	name := client.name
+	account := client.account
+	mu.Unlock()
+
+	applyPreferences(conn, prefs)
+	if account {
+		saveAccountPrefs(name, prefs)
+	}
+	if pref.key != "color" {
+		conn.Write([]byte("Your " + pref.key + " setting is now " + pref.show(prefs) + "\n"))
+	}
+}
+
+// savedColor returns the color saved by a registered user, or empty strings
+// if there is none or someone else uses it
+func savedColor(conn net.Conn, name string) (string, string) {
+	prefs, _ := accountPrefs(name)
+	if prefs.Color == "" {
+		return "", ""
+	}
+	escape, colorCode := GetColorByChoice(prefs.Color)
+	if escape == "" || colorInUse(conn, colorCode) {
+		return "", ""
+	}
+	return escape, colorCode
+}
+
+// applyPreferences makes a connection show timestamps the way the user wants
+func applyPreferences(conn net.Conn, prefs Preferences) {
+	if c, ok := conn.(*ClientConn); ok {
+		c.SetTimeDisplay(timeFormats[orDefault(prefs.TimeFormat, "full")], prefs.location())
+	}
+}
+
+// SetTimeDisplay changes the layout and timezone of the timestamps sent to the client
+func (c *ClientConn) SetTimeDisplay(layout string, loc *time.Location) {
+	c.termMu.Lock()
+	defer c.termMu.Unlock()
+
+	c.timeLayout = layout
+	c.location = loc
+}
+
+// timeDisplay returns the layout and timezone of the client's timestamps,
+// clients that did not choose get the full layout in the server's timezone
+func (c *ClientConn) timeDisplay() (string, *time.Location) {
+	c.termMu.Lock()
+	defer c.termMu.Unlock()
+
+	layout, loc := c.timeLayout, c.location
+	if layout == "" {
+		layout = TimestampLayout
+	}
+	if loc == nil {
+		loc = time.Local
+	}
+	return layout, loc
+}
+
+// stamp returns the timestamp put in front of a message for a client, in the
+// client's layout and timezone, JSON clients always get UTC
+func stamp(conn net.Conn, t time.Time) string {
+	layout, loc := TimestampLayout, time.Local
+	if c, ok := conn.(*ClientConn); ok && c.IsJSON() {
+		loc = time.UTC
+	} else if ok {
+		layout, loc = c.timeDisplay()
+	}
+	return "[" + t.In(loc).Format(layout) + "]"
+}
+
+// localTime formats a time in the timezone of a client
+func localTime(conn net.Conn, t time.Time) string {
+	loc := time.Local
+	if c, ok := conn.(*ClientConn); ok {
+		_, loc = c.timeDisplay()
+	}
+	return t.In(loc).Format(TimestampLayout)
+}
+
+// ShowTimezone tells a user which timezone their timestamps are shown in
+func ShowTimezone(conn net.Conn) {
+	mu.Lock()
+	client, exists := Clients[conn]
+	if !exists {
+		mu.Unlock()
+		return
+	}
+	prefs := client.prefs
+	mu.Unlock()
+
+	now := time.Now().In(prefs.location())
+	conn.Write([]byte("Your timezone is " + orDefault(prefs.Timezone, "the server's") + ", it is " + now.Format("15:04 MST") + " there\n"))
+}
@@ -0,0 +1,127 @@
+package utilities
+
+import (
+	"net"
+	"strings"
+)
+
+// Maximum length of a status or away message
+const MaxStatusLength = 60
+
+// SetAway marks the user as away with an optional reason
+func SetAway(conn net.Conn, reason string) {
+	if len(reason) > MaxStatusLength {
+		conn.Write([]byte(FormatErrorMessage("\nError: Away message is too long.") + "\n"))
+		return
+	}
+
+	mu.Lock()
+	client, exists := Clients[conn]
+	if !exists {
+		mu.Unlock()
+		return
+	}
+	client.away = true
+	client.autoAway = false
+	client.awayReason = reason
+	name := client.name
+	mu.Unlock()
+
+	if reason == "" {
+		conn.Write([]byte("You are now marked as away\n"))
+	} else {
+		conn.Write([]byte("You are now marked as away: " + reason + "\n"))
+	}
+	chatLogger.Log("chat", "User "+name+" is away "+reason)
+}
+
+// SetBack clears the user's away status
+func SetBack(conn net.Conn) {
+	mu.Lock()
+	client, exists := Clients[conn]
+	if !exists || !client.away {
+		mu.Unlock()
+		conn.Write([]byte(FormatErrorMessage("\nError: You are not away.") + "\n"))
+		return
+	}
+	client.away = false
+	client.autoAway = false
+	client.awayReason = ""
+	name := client.name
+	mu.Unlock()
+
+	conn.Write([]byte("You are no longer marked as away\n"))
+	chatLogger.Log("chat", "User "+name+" is back")
+}
+
+// SetStatus changes the custom status shown next to the user's name, empty text clears it
+func SetStatus(conn net.Conn, status string) {
+	if len(status) > MaxStatusLength {
+		conn.Write([]byte(FormatErrorMessage("\nError: Status is too long.") + "\n"))
+		return
+	}
+
+	mu.Lock()
+	client, exists := Clients[conn]
+	if !exists {
+		mu.Unlock()
+		return
+	}
+	client.status = status
+	mu.Unlock()
+
+	if status == "" {
+		conn.Write([]byte("Your status has been cleared\n"))
+	} else {
+		conn.Write([]byte("Your status is now: " + status + "\n"))
+	}
+}
+
+// markAutoAway marks an idle user as away, mu must be held
+func markAutoAway(conn net.Conn, client *UserInfo) {
+	if client.away {
+		return
+	}
+	client.away = true
+	client.autoAway = true
+	client.awayReason = "idle"
+	Notify(conn, "\nYou have been marked as away due to inactivity.\n")
+}
+
+// clearAutoAway brings back a user that was marked away automatically, mu must be held
+func clearAutoAway(conn net.Conn, client *UserInfo) {
+	if !client.autoAway {
+		return
+	}
+	client.away = false
+	client.autoAway = false
+	client.awayReason = ""
+	conn.Write([]byte("You are no longer marked as away\n"))
+}
+
+// presenceText describes the user's away state and status for user lists, mu must be held
+func presenceText(client *UserInfo) string {
+	var parts []string
+	if client.away {
+		if client.awayReason != "" {
+			parts = append(parts, "away: "+client.awayReason)
+		} else {
+			parts = append(parts, "away")
+		}
+	}
+	if client.status != "" {
+		parts = append(parts, "status: "+client.status)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return " [" + strings.Join(parts, ", ") + "]"
+}
+
+// awayNotice returns the automatic reply for a direct message to an away user, mu must be held
+func awayNotice(client *UserInfo) string {
+	if client.awayReason == "" {
+		return FormatSystemMessage(client.name+" is away") + "\n"
+	}
+	return FormatSystemMessage(client.name+" is away: "+client.awayReason) + "\n"
+}
@@ -0,0 +1,260 @@
+package utilities
+
+import (
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// RenderMode is how output is formatted for a client's terminal
+type RenderMode int
+
+const (
+	// Plain ASCII without escape codes, for scripts, logs and simple consoles
+	ModePlain RenderMode = iota
+	// The 16 basic ANSI colors
+	ModeANSI
+	// The 256 color xterm palette
+	Mode256Color
+)
+
+// Names of the render modes used by the /mode command
+var renderModeNames = map[RenderMode]string{
+	ModePlain:    "plain",
+	ModeANSI:     "ansi",
+	Mode256Color: "256color",
+}
+
+func (m RenderMode) String() string {
+	return renderModeNames[m]
+}
+
+// ParseRenderMode returns the mode with the given name
+func ParseRenderMode(name string) (RenderMode, bool) {
+	for mode, modeName := range renderModeNames {
+		if modeName == strings.ToLower(name) {
+			return mode, true
+		}
+	}
+	return ModePlain, false
+}
+
+// DetectRenderMode guesses the render mode from the terminal type a telnet client
+// reported, clients on the main port report "script" when they sent input before
+// the first prompt
+func DetectRenderMode(termType string) RenderMode {
+	switch {
+	case termType == scriptTerminal:
+		return ModePlain
+	case termType == "":
+		// Clients that say nothing, like nc, get the full colors as before
+		return Mode256Color
+	case strings.Contains(termType, "256color"), strings.Contains(termType, "truecolor"),
+		strings.Contains(termType, "direct"), strings.HasPrefix(termType, "xterm"):
+		return Mode256Color
+	case strings.HasPrefix(termType, "vt"), strings.HasPrefix(termType, "ansi"),
+		strings.HasPrefix(termType, "linux"), strings.HasPrefix(termType, "screen"),
+		strings.HasPrefix(termType, "tmux"), strings.HasPrefix(termType, "rxvt"):
+		return ModeANSI
+	default:
+		// dumb, unknown and anything we do not recognize
+		return ModePlain
+	}
+}
+
+var (
+	// Matches every CSI escape sequence, colors as well as cursor movement
+	escapePattern = regexp.MustCompile("\x1b\\[[0-9;?]*[ -/]*[@-~]")
+
+	// Matches SGR sequences that set colors and text attributes
+	sgrPattern = regexp.MustCompile("\x1b\\[([0-9;]*)m")
+
+	// ASCII replacements for the box drawing characters used in menus and notices
+	boxReplacer = strings.NewReplacer(
+		"╔", "+", "╗", "+", "╚", "+", "╝", "+",
+		"═", "-", "║", "|",
+	)
+
+	// ASCII spellings of punctuation and letters that have no decomposition
+	asciiReplacer = strings.NewReplacer(
+		"“", "\"", "”", "\"", "„", "\"", "‘", "'", "’", "'", "«", "<<", "»", ">>",
+		"–", "-", "—", "-", "•", "*", "·", ".", "→", "->", "←", "<-", "×", "x",
+		"ß", "ss", "æ", "ae", "Æ", "AE", "œ", "oe", "Œ", "OE", "ø", "o", "Ø", "O",
+		"ł", "l", "Ł", "L", "đ", "d", "Đ", "D", "þ", "th", "Þ", "Th", "ı", "i",
+	)
+)
+
+// Render formats text for a client in the given mode, the text is written
+// with 256 color codes and truecolor codes are accepted as well
+func Render(text string, mode RenderMode) string {
+	switch mode {
+	case ModePlain:
+		return toASCII(stripEscapes(text))
+	case ModeANSI:
+		return sgrPattern.ReplaceAllStringFunc(text, func(seq string) string {
+			return convertSGR(seq, toANSI16)
+		})
+	default:
+		return sgrPattern.ReplaceAllStringFunc(text, func(seq string) string {
+			return convertSGR(seq, to256)
+		})
+	}
+}
+
+// stripEscapes removes the escape codes and box drawing from text but keeps
+// other characters, for clients like bots that read UTF-8 but no terminal codes
+func stripEscapes(text string) string {
+	return boxReplacer.Replace(escapePattern.ReplaceAllString(text, ""))
+}
+
+// toASCII spells text in plain ASCII: accents are dropped, compatibility
+// characters like fullwidth letters are replaced by their ASCII form and
+// anything else outside ASCII becomes a question mark
+func toASCII(text string) string {
+	text = asciiReplacer.Replace(norm.NFKD.String(text))
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r < utf8.RuneSelf:
+			return r
+		case unicode.Is(unicode.Mn, r):
+			return -1
+		default:
+			return '?'
+		}
+	}, text)
+}
+
+// convertSGR rewrites the extended foreground and background colors of an SGR sequence
+func convertSGR(seq string, convert func(r, g, b int, background bool) string) string {
+	params := strings.Split(sgrPattern.FindStringSubmatch(seq)[1], ";")
+	var out []string
+
+	for i := 0; i < len(params); i++ {
+		p := params[i]
+		if (p == "38" || p == "48") && i+1 < len(params) {
+			background := p == "48"
+			switch {
+			case params[i+1] == "5" && i+2 < len(params):
+				n, _ := strconv.Atoi(params[i+2])
+				r, g, b := xtermRGB(n)
+				out = append(out, convert(r, g, b, background))
+				i += 2
+				continue
+			case params[i+1] == "2" && i+4 < len(params):
+				r, _ := strconv.Atoi(params[i+2])
+				g, _ := strconv.Atoi(params[i+3])
+				b, _ := strconv.Atoi(params[i+4])
+				out = append(out, convert(r, g, b, background))
+				i += 4
+				continue
+			}
+		}
+		out = append(out, p)
+	}
+	return "\x1b[" + strings.Join(out, ";") + "m"
+}
+
+// The 16 basic colors as xterm draws them
+var ansi16RGB = [16][3]int{
+	{0, 0, 0}, {205, 0, 0}, {0, 205, 0}, {205, 205, 0},
+	{0, 0, 238}, {205, 0, 205}, {0, 205, 205}, {229, 229, 229},
+	{127, 127, 127}, {255, 0, 0}, {0, 255, 0}, {255, 255, 0},
+	{92, 92, 255}, {255, 0, 255}, {0, 255, 255}, {255, 255, 255},
+}
+
+// Levels of the 6x6x6 color cube of the 256 color palette
+var cubeLevels = [6]int{0, 95, 135, 175, 215, 255}
+
+// xtermRGB returns the RGB value of a color from the 256 color palette
+func xtermRGB(n int) (int, int, int) {
+	switch {
+	case n < 16:
+		c := ansi16RGB[n]
+		return c[0], c[1], c[2]
+	case n < 232:
+		n -= 16
+		return cubeLevels[n/36], cubeLevels[n/6%6], cubeLevels[n%6]
+	case n < 256:
+		gray := 8 + (n-232)*10
+		return gray, gray, gray
+	default:
+		return 255, 255, 255
+	}
+}
+
+// colorDistance compares two colors
+func colorDistance(r1, g1, b1, r2, g2, b2 int) int {
+	return (r1-r2)*(r1-r2) + (g1-g2)*(g1-g2) + (b1-b2)*(b1-b2)
+}
+
+// toANSI16 returns the SGR parameter of the nearest basic color
+func toANSI16(r, g, b int, background bool) string {
+	best, bestDistance := 0, -1
+	for i, c := range ansi16RGB {
+		d := colorDistance(r, g, b, c[0], c[1], c[2])
+		if bestDistance < 0 || d < bestDistance {
+			best, bestDistance = i, d
+		}
+	}
+
+	base := 30
+	if background {
+		base = 40
+	}
+	if best >= 8 {
+		return strconv.Itoa(base + 60 + best - 8)
+	}
+	return strconv.Itoa(base + best)
+}
+
+// to256 returns the SGR parameters of the nearest color of the 256 color palette
+func to256(r, g, b int, background bool) string {
+	best, bestDistance := 16, -1
+	for n := 16; n < 256; n++ {
+		cr, cg, cb := xtermRGB(n)
+		d := colorDistance(r, g, b, cr, cg, cb)
+		if bestDistance < 0 || d < bestDistance {
+			best, bestDistance = n, d
+		}
+	}
+
+	if background {
+		return "48;5;" + strconv.Itoa(best)
+	}
+	return "38;5;" + strconv.Itoa(best)
+}
+
+// renderMode returns the render mode of a client
+func renderMode(conn net.Conn) RenderMode {
+	if c, ok := conn.(*ClientConn); ok {
+		return c.Mode()
+	}
+	return Mode256Color
+}
+
+// ChangeMode sets the render mode of a client, without a name it shows the current mode
+func ChangeMode(conn net.Conn, name string) {
+	c, ok := conn.(*ClientConn)
+	if !ok {
+		return
+	}
+
+	if name == "" {
+		conn.Write([]byte("Your display mode is " + c.Mode().String() + " (plain, ansi or 256color)\n"))
+		return
+	}
+
+	mode, valid := ParseRenderMode(name)
+	if !valid {
+		conn.Write([]byte(FormatErrorMessage("\nError: Unknown mode "+name+", use plain, ansi or 256color.") + "\n"))
+		return
+	}
+
+	c.SetMode(mode)
+	conn.Write([]byte("Your display mode is now " + mode.String() + "\n"))
+}
@@ -0,0 +1,217 @@
+package utilities
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Maximum number of events kept for a user whose connection was lost
+const MaxMissedEvents = 100
+
+// missedEvent is an event delivered while the connection of its receiver was lost
+type missedEvent struct {
+	ev   Event
+	text string
+}
+
+// newResumeToken returns a random token a user can resume their session with
+func newResumeToken() string {
+	token := make([]byte, 8)
+	if _, err := rand.Read(token); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(token)
+}
+
+// resumeNotice tells a user how to get back into the chat after a lost connection
+func resumeNotice(token string) string {
+	return fmt.Sprintf("If your connection drops, enter /resume %s instead of your name within %v to continue where you left off.\n",
+		token, ServerConfig.ResumeGrace.Duration)
+}
+
+// holdMissed keeps an event for a client whose connection was lost, it reports
+// whether the event was kept instead of sent
+func (c *ClientConn) holdMissed(ev Event, text string) bool {
+	c.resumeMu.Lock()
+	defer c.resumeMu.Unlock()
+
+	if !c.suspended {
+		return false
+	}
+	c.missed = append(c.missed, missedEvent{ev: ev, text: text})
+	if len(c.missed) > MaxMissedEvents {
+		c.missed = c.missed[len(c.missed)-MaxMissedEvents:]
+	}
+	return true
+}
+
+// Suspend keeps the session of a user whose connection was lost for the resume
+// grace period, it reports false when sessions cannot be resumed and the user
+// has to be logged out
+func Suspend(conn net.Conn) bool {
+	c, ok := conn.(*ClientConn)
+	grace := ServerConfig.ResumeGrace.Duration
+	if !ok || grace <= 0 {
+		return false
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// Users with other sessions are still in the chat and are simply logged out here
+	client, exists := Clients[conn]
+	if !exists || client.resumeToken == "" || len(sessionsOf(client)) > 1 {
+		return false
+	}
+
+	c.resumeMu.Lock()
+	c.suspended = true
+	c.resumeTimer = time.AfterFunc(grace, func() { expireSession(conn) })
+	c.resumeMu.Unlock()
+	conn.Close()
+
+	// The user may reconnect from the same address
+	releaseAddress(conn.RemoteAddr().(*net.TCPAddr).IP.String())
+	stopIdleTimer(conn)
+	forgetColorMenu(conn)
+
+	chatLogger.Log("connection", "User "+client.name+" "+client.ipAddr+" lost the connection, the session is kept for "+grace.String())
+	return true
+}
+
+// expireSession logs out a user who did not resume their session in time
+func expireSession(conn net.Conn) {
+	mu.Lock()
+	info, exists := Clients[conn]
+	if !exists {
+		mu.Unlock()
+		return
+	}
+	delete(Clients, conn)
+	lastSession := len(sessionsOf(info)) == 0
+	if lastSession && !info.account {
+		forgetGuest(info.name)
+	}
+	mu.Unlock()
+
+	chatLogger.Log("connection", "User "+info.name+" "+info.ipAddr+" did not resume the session")
+	if lastSession {
+		BroadCast(conn, FormatExitMessage(info.name), userEvent(EventLeave, info))
+	}
+	conn.Close()
+}
+
+// ResumeSession moves the session a token belongs to onto a new connection and
+// replays what the user missed, no join or leave is announced
+func ResumeSession(conn *ClientConn, token string) error {
+	token = strings.TrimSpace(token)
+
+	mu.Lock()
+	var oldConn *ClientConn
+	var user *UserInfo
+	for client, info := range Clients {
+		if c, ok := client.(*ClientConn); ok && token != "" && info.resumeToken == token && c.isSuspended() {
+			oldConn, user = c, info
+		}
+	}
+	if user == nil {
+		mu.Unlock()
+		return fmt.Errorf("unknown or expired resume token")
+	}
+
+	// The same address rule as for a normal login, this connection is already counted
+	ipAddr := conn.RemoteAddr().(*net.TCPAddr).IP.String()
+	if remoteAddresses[ipAddr] > 1 && !(user.account && len(sessionsOf(user)) > 1) {
+		mu.Unlock()
+		return fmt.Errorf("you are already connected to the chat")
+	}
+
+	delete(Clients, oldConn)
+	Clients[conn] = user
+	user.ipAddr = ipAddr
+	user.lastActive = time.Now()
+	scheduleIdleCheck(conn, user)
+	applyPreferences(conn, user.prefs)
+
+	oldConn.resumeMu.Lock()
+	oldConn.resumeTimer.Stop()
+	missed := oldConn.missed
+	oldConn.missed = nil
+	oldConn.resumeMu.Unlock()
+
+	// Replay while mu is held so new messages arrive after the missed ones
+	if conn.IsJSON() {
+		ev := userEvent(EventWelcome, user)
+		ev.Token = token
+		conn.WriteEvent(ev)
+	} else {
+		conn.Write([]byte(fmt.Sprintf("\nWelcome back, %s%s%s! You missed %d messages.\n", user.color, user.name, Reset, len(missed))))
+	}
+	for _, m := range missed {
+		SendEvent(conn, m.ev, m.text)
+	}
+	// Direct messages were queued while the connection was lost
+	DeliverOfflineMessages(conn, user.name)
+	mu.Unlock()
+
+	warningMu.Lock()
+	delete(inWarningResponse, oldConn)
+	warningMu.Unlock()
+	warnedUsersMu.Lock()
+	delete(warnedUsers, oldConn)
+	warnedUsersMu.Unlock()
+
+	chatLogger.Log("connection", "User "+user.name+" "+user.ipAddr+" resumed the session")
+	return nil
+}
+
+// isSuspended reports whether the connection was lost and its session waits to be resumed
+func (c *ClientConn) isSuspended() bool {
+	c.resumeMu.Lock()
+	defer c.resumeMu.Unlock()
+
+	return c.suspended
+}
+
+// suspendedConn reports whether a connection was lost and its session waits to be resumed
+func suspendedConn(conn net.Conn) bool {
+	c, ok := conn.(*ClientConn)
+	return ok && c.isSuspended()
+}
+
+// reconnecting reports whether every session of a user lost its connection, mu must be held
+func reconnecting(user *UserInfo) bool {
+	for _, session := range sessionsOf(user) {
+		if !suspendedConn(session) {
+			return false
+		}
+	}
+	return true
+}
+
+// connectedClients counts the sessions that are not waiting to be resumed, mu must be held
+func connectedClients() int {
+	count := 0
+	for client := range Clients {
+		if !suspendedConn(client) {
+			count++
+		}
+	}
+	return count
+}
+
+// resumedName returns the name of the user whose session a connection took
+// over instead of logging in
+func resumedName(conn net.Conn) (string, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if client, exists := Clients[conn]; exists {
+		return client.name, true
+	}
+	return "", false
+}
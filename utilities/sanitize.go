@@ -0,0 +1,131 @@
+package utilities
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Matches every escape sequence a terminal understands: CSI sequences like
+// colors and cursor movement, OSC sequences like window titles and two byte escapes
+var inputEscapePattern = regexp.MustCompile("\x1b(\\[[0-?]*[ -/]*[@-~]|\\][^\x07\x1b]*(\x07|\x1b\\\\)?|[ -~]?)")
+
+// SGR parameters allowed by each formatting name of the allowed_formatting setting
+var formattingParams = map[string]func(n int) bool{
+	"bold":       func(n int) bool { return n == 1 || n == 22 },
+	"dim":        func(n int) bool { return n == 2 || n == 22 },
+	"italic":     func(n int) bool { return n == 3 || n == 23 },
+	"underline":  func(n int) bool { return n == 4 || n == 24 },
+	"reverse":    func(n int) bool { return n == 7 || n == 27 },
+	"color":      func(n int) bool { return n >= 30 && n <= 39 || n >= 90 && n <= 97 },
+	"background": func(n int) bool { return n >= 40 && n <= 49 || n >= 100 && n <= 107 },
+}
+
+// checkAllowedFormatting validates the allowed_formatting setting
+func checkAllowedFormatting(names []string) error {
+	for _, name := range names {
+		if formattingParams[name] == nil {
+			return fmt.Errorf("unknown formatting %s in allowed_formatting", name)
+		}
+	}
+	return nil
+}
+
+// SanitizeInput cleans text typed by a user before anyone else sees it: invalid
+// UTF-8 is replaced, control characters are removed and escape sequences are
+// removed unless they only use the formatting allowed in the config
+func SanitizeInput(text string) string {
+	return sanitize(text, true)
+}
+
+// SanitizeName cleans a username, names never keep any formatting
+func SanitizeName(name string) string {
+	return norm.NFC.String(sanitize(name, false))
+}
+
+// sanitize removes everything from text that could change another user's terminal
+func sanitize(text string, allowFormatting bool) string {
+	text = strings.ToValidUTF8(text, "\ufffd")
+
+	formatted := false
+	text = inputEscapePattern.ReplaceAllStringFunc(text, func(seq string) string {
+		if allowFormatting && allowedSGR(seq) {
+			formatted = true
+			return seq
+		}
+		return ""
+	})
+
+	text = strings.Map(func(r rune) rune {
+		switch {
+		case r == '\t':
+			return ' '
+		case r == '\x1b' && formatted:
+			return r
+		case unicode.IsControl(r), isBidiControl(r):
+			return -1
+		}
+		return r
+	}, text)
+
+	// Formatting must not spill into the text that follows the message
+	if formatted {
+		text += Reset
+	}
+	return text
+}
+
+// allowedSGR reports whether an escape sequence only sets allowed formatting
+func allowedSGR(seq string) bool {
+	if len(ServerConfig.AllowedFormatting) == 0 {
+		return false
+	}
+	match := sgrPattern.FindStringSubmatch(seq)
+	if match == nil || match[0] != seq {
+		return false
+	}
+
+	params := strings.Split(match[1], ";")
+	for i := 0; i < len(params); i++ {
+		if params[i] == "" || params[i] == "0" {
+			continue // reset is always fine
+		}
+		n, err := strconv.Atoi(params[i])
+		if err != nil || !formattingAllowed(n) {
+			return false
+		}
+
+		// 256 color and true color sequences take extra parameters
+		if n == 38 || n == 48 {
+			switch {
+			case i+2 < len(params) && params[i+1] == "5":
+				i += 2
+			case i+4 < len(params) && params[i+1] == "2":
+				i += 4
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// formattingAllowed reports whether one of the allowed formattings uses an SGR parameter
+func formattingAllowed(n int) bool {
+	for _, name := range ServerConfig.AllowedFormatting {
+		if formattingParams[name](n) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBidiControl reports whether a rune changes the direction of the text around
+// it, these can make a message look like it says something else
+func isBidiControl(r rune) bool {
+	return r >= '\u202a' && r <= '\u202e' || r >= '\u2066' && r <= '\u2069'
+}
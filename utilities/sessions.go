@@ -0,0 +1,82 @@
+package utilities
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"time"
+)
+
+// sessionsOf returns the connections a user is logged in with, mu must be held
+func sessionsOf(user *UserInfo) []net.Conn {
+	var sessions []net.Conn
+	for client, info := range Clients {
+		if info == user {
+			sessions = append(sessions, client)
+		}
+	}
+	return sessions
+}
+
+// connectedSessions counts the sessions of a user that are not waiting to be resumed, mu must be held
+func connectedSessions(user *UserInfo) int {
+	count := 0
+	for _, session := range sessionsOf(user) {
+		if !suspendedConn(session) {
+			count++
+		}
+	}
+	return count
+}
+
+// onlineAccount returns the user of a registered account who is logged in, mu must be held
+func onlineAccount(name string) *UserInfo {
+	for _, info := range Clients {
+		if info.account && sameName(info.name, name) {
+			return info
+		}
+	}
+	return nil
+}
+
+// forgetGuest drops what was kept for a guest whose last session closed, so
+// whoever takes the name next cannot see it, mu must be held
+func forgetGuest(name string) {
+	forgetIgnored(name)
+	dropOfflineMessages(name)
+	dropConversations(name)
+}
+
+// releaseAddress forgets one connection from an IP address, mu must be held
+func releaseAddress(ipAddr string) {
+	if remoteAddresses[ipAddr]--; remoteAddresses[ipAddr] <= 0 {
+		delete(remoteAddresses, ipAddr)
+	}
+}
+
+// openSession adds another connection to a registered user who is already
+// logged in, nobody sees a join and every session gets the user's messages
+func openSession(conn *ClientConn, reader *bufio.Reader, user *UserInfo) {
+	mu.Lock()
+	Clients[conn] = user
+	user.lastActive = time.Now()
+	scheduleIdleCheck(conn, user)
+	name := user.name
+	prefs := user.prefs
+	sessions := connectedSessions(user)
+	mu.Unlock()
+
+	if !conn.IsJSON() && !prefs.HidePenguin {
+		PrintLogo(conn)
+	}
+	applyPreferences(conn, prefs)
+	chatLogger.Log("connection", fmt.Sprintf("User %s %s opened session %d", name, conn.RemoteAddr().(*net.TCPAddr).IP.String(), sessions))
+
+	SendMessageHistory(conn)
+	sendWelcome(conn, user)
+	if sessions > 1 {
+		conn.Write([]byte(fmt.Sprintf("You are logged in %d times, messages reach all of your sessions.\n", sessions)))
+	}
+
+	go handleMessages(conn, reader, name)
+}
@@ -0,0 +1,439 @@
+package utilities
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Telnet commands and options, see RFC 854, 857, 858, 1073 and 1091
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	optEcho  = 1
+	optSGA   = 3
+	optTType = 24
+	optNAWS  = 31
+
+	ttypeIS   = 0
+	ttypeSEND = 1
+)
+
+// Time to wait for the client's answers before the first prompt is shown
+const telnetNegotiationTimeout = 500 * time.Millisecond
+
+// Time in which input on the main port shows the client is a script, people
+// cannot type before they saw the first prompt
+const scriptDetectTimeout = 100 * time.Millisecond
+
+// Terminal type given to main port clients that sent input before the first prompt
+const scriptTerminal = "script"
+
+// States of the telnet input parser
+const (
+	stateData = iota
+	stateIAC
+	stateOption
+	stateSB
+	stateSBIAC
+)
+
+// ClientConn wraps a client connection, it removes telnet control sequences from
+// the input and keeps what the client told us about its terminal
+type ClientConn struct {
+	net.Conn
+
+	// Whether the server starts telnet negotiation for this connection
+	telnet bool
+
+	termMu   sync.Mutex
+	width    int        // terminal width in columns, 0 if unknown
+	termType string     // terminal type reported by the client
+	mode     RenderMode // how output is formatted for the terminal
+	json     bool       // the client uses the JSON protocol
+
+	// Keepalive state, the client is only expected to answer once it did
+	pinging      bool
+	answersPings bool
+
+	// Layout and timezone of the timestamps shown to the client
+	timeLayout string
+	location   *time.Location
+
+	// Input parser state, only used by the reading goroutine
+	state   int
+	command byte
+	sb      []byte
+	pending []byte
+
+	// Options we already answered or asked for, to avoid negotiation loops
+	sentDo   map[byte]bool
+	sentWill map[byte]bool
+
+	// Server side line editor, set once the client lets the server echo
+	editMu sync.Mutex
+	editor *lineEditor
+
+	// Response being collected for a JSON request
+	jsonMu  sync.Mutex
+	request *jsonResponse
+
+	// Set when the connection was lost, events are kept until the session is resumed
+	resumeMu    sync.Mutex
+	suspended   bool
+	missed      []missedEvent
+	resumeTimer *time.Timer // ends the session when it is not resumed in time
+}
+
+// NewClientConn wraps conn, telnet negotiation is started when telnet is true
+func NewClientConn(conn net.Conn, telnet bool) *ClientConn {
+	c := &ClientConn{
+		Conn:     conn,
+		telnet:   telnet,
+		mode:     Mode256Color,
+		sentDo:   make(map[byte]bool),
+		sentWill: make(map[byte]bool),
+	}
+	setKeepAlive(conn)
+	if telnet {
+		c.negotiate()
+		_, termType := c.Terminal()
+		c.SetMode(DetectRenderMode(termType))
+		c.startPings()
+	} else {
+		c.detectScript()
+	}
+	return c
+}
+
+// detectScript waits briefly for input on the main port, clients that send it
+// before any prompt are scripts or piped tools and get plain output
+func (c *ClientConn) detectScript() {
+	c.Conn.SetReadDeadline(time.Now().Add(scriptDetectTimeout))
+	buf := make([]byte, 512)
+	if n, err := c.Conn.Read(buf); n > 0 {
+		c.pending = append(c.pending, c.input(buf[:n])...)
+	} else if err != nil && !isTimeout(err) {
+		return
+	}
+	c.Conn.SetReadDeadline(time.Time{})
+
+	if len(c.pending) > 0 {
+		c.termMu.Lock()
+		c.termType = scriptTerminal
+		c.termMu.Unlock()
+		c.SetMode(DetectRenderMode(scriptTerminal))
+	}
+}
+
+// isTimeout reports whether a read failed because its deadline passed
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// negotiate asks the client for its terminal details and waits briefly for the answers
+func (c *ClientConn) negotiate() {
+	c.sendOption(telnetWILL, optEcho)
+	c.sendOption(telnetWILL, optSGA)
+	c.sendOption(telnetDO, optNAWS)
+	c.sendOption(telnetDO, optTType)
+
+	deadline := time.Now().Add(telnetNegotiationTimeout)
+	c.Conn.SetReadDeadline(deadline)
+	buf := make([]byte, 512)
+	for time.Now().Before(deadline) {
+		n, err := c.Conn.Read(buf)
+		if err != nil {
+			break
+		}
+		c.pending = append(c.pending, c.input(buf[:n])...)
+
+		c.termMu.Lock()
+		done := c.width > 0 && c.termType != ""
+		c.termMu.Unlock()
+		if done {
+			break
+		}
+	}
+	c.Conn.SetReadDeadline(time.Time{})
+}
+
+// Read returns the client's input without telnet control sequences
+func (c *ClientConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		c.setReadDeadline()
+		buf := make([]byte, len(p))
+		n, err := c.Conn.Read(buf)
+		if n > 0 {
+			c.pending = c.input(buf[:n])
+		}
+		if err != nil && len(c.pending) == 0 {
+			return 0, err
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write sends text to the client, above the input line when the line editor is used
+func (c *ClientConn) Write(p []byte) (int, error) {
+	if c.IsJSON() {
+		c.writeJSONText(string(p))
+		return len(p), nil
+	}
+
+	text := Render(string(p), c.Mode())
+
+	c.editMu.Lock()
+	defer c.editMu.Unlock()
+
+	if c.editor == nil {
+		if _, err := c.send([]byte(text)); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if _, err := c.send([]byte(c.editor.output(text))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// input turns raw bytes from the client into the data returned by Read
+func (c *ClientConn) input(raw []byte) []byte {
+	data := c.parse(raw)
+
+	var words completionWords
+	if bytes.IndexByte(data, keyTab) >= 0 {
+		words = collectCompletionWords(c)
+	}
+
+	c.editMu.Lock()
+	defer c.editMu.Unlock()
+
+	if c.editor == nil {
+		return data
+	}
+	c.editor.words = words
+
+	// Echo the keys and only hand over finished lines
+	if echo := c.editor.feed(data); len(echo) > 0 {
+		c.send(echo)
+	}
+	lines := c.editor.complete
+	c.editor.complete = nil
+	return lines
+}
+
+// parse runs the telnet state machine over the input and returns the plain data
+func (c *ClientConn) parse(input []byte) []byte {
+	var data []byte
+	for _, b := range input {
+		switch c.state {
+		case stateData:
+			if b == telnetIAC {
+				c.state = stateIAC
+			} else if b != 0 { // telnet sends a NUL after a bare carriage return
+				data = append(data, b)
+			}
+		case stateIAC:
+			switch b {
+			case telnetIAC:
+				data = append(data, b)
+				c.state = stateData
+			case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+				c.command = b
+				c.state = stateOption
+			case telnetSB:
+				c.sb = c.sb[:0]
+				c.state = stateSB
+			default:
+				// Other commands like NOP or GA carry no data
+				c.state = stateData
+			}
+		case stateOption:
+			c.handleOption(c.command, b)
+			c.state = stateData
+		case stateSB:
+			if b == telnetIAC {
+				c.state = stateSBIAC
+			} else {
+				c.sb = append(c.sb, b)
+			}
+		case stateSBIAC:
+			if b == telnetSE {
+				c.handleSubnegotiation(c.sb)
+				c.state = stateData
+			} else {
+				// An escaped IAC inside the subnegotiation
+				c.sb = append(c.sb, b)
+				c.state = stateSB
+			}
+		}
+	}
+	return data
+}
+
+// handleOption answers the client's WILL, WONT, DO and DONT requests
+func (c *ClientConn) handleOption(command, option byte) {
+	// The answer to a ping, it is not negotiated further
+	if option == optTimingMark && (command == telnetWILL || command == telnetWONT) {
+		c.pingAnswered()
+		return
+	}
+
+	switch command {
+	case telnetWILL:
+		if option == optNAWS || option == optTType {
+			c.sendOption(telnetDO, option)
+		} else {
+			c.sendOption(telnetDONT, option)
+		}
+		if option == optTType {
+			c.send([]byte{telnetIAC, telnetSB, optTType, ttypeSEND, telnetIAC, telnetSE})
+		}
+	case telnetDO:
+		if option == optSGA {
+			c.sendOption(telnetWILL, option)
+		} else if option == optEcho && c.telnet && c.Mode() != ModePlain {
+			// The client stopped echoing locally, so the server edits the line
+			c.sendOption(telnetWILL, option)
+			c.editMu.Lock()
+			if c.editor == nil {
+				c.editor = &lineEditor{}
+			}
+			c.editMu.Unlock()
+		} else {
+			c.sendOption(telnetWONT, option)
+		}
+	case telnetDONT:
+		if option == optEcho {
+			c.editMu.Lock()
+			c.editor = nil
+			c.editMu.Unlock()
+		}
+	}
+}
+
+// sendOption sends a negotiation command once per option
+func (c *ClientConn) sendOption(command, option byte) {
+	sent := c.sentDo
+	if command == telnetWILL || command == telnetWONT {
+		sent = c.sentWill
+	}
+	if _, done := sent[option]; done {
+		return
+	}
+	sent[option] = true
+	c.send([]byte{telnetIAC, command, option})
+}
+
+// handleSubnegotiation stores the terminal size and type sent by the client
+func (c *ClientConn) handleSubnegotiation(sb []byte) {
+	if len(sb) == 0 {
+		return
+	}
+
+	c.termMu.Lock()
+	defer c.termMu.Unlock()
+
+	switch sb[0] {
+	case optNAWS:
+		if len(sb) >= 5 {
+			c.width = int(binary.BigEndian.Uint16(sb[1:3]))
+		}
+	case optTType:
+		if len(sb) >= 2 && sb[1] == ttypeIS {
+			c.termType = strings.ToLower(string(sb[2:]))
+		}
+	}
+}
+
+// Terminal returns the terminal width and type, zero values when they are unknown
+func (c *ClientConn) Terminal() (int, string) {
+	c.termMu.Lock()
+	defer c.termMu.Unlock()
+
+	return c.width, c.termType
+}
+
+// Mode returns how output is formatted for the client
+func (c *ClientConn) Mode() RenderMode {
+	c.termMu.Lock()
+	defer c.termMu.Unlock()
+
+	return c.mode
+}
+
+// SetMode changes how output is formatted for the client. The line editor needs
+// escape codes, so plain mode hands echoing back to the client and leaving plain
+// mode offers the editor again.
+func (c *ClientConn) SetMode(mode RenderMode) {
+	c.termMu.Lock()
+	previous := c.mode
+	c.mode = mode
+	c.termMu.Unlock()
+
+	if mode != ModePlain {
+		if previous == ModePlain && c.telnet {
+			// The client answers DO ECHO and the editor is set up in handleOption
+			delete(c.sentWill, optEcho)
+			c.sendOption(telnetWILL, optEcho)
+		}
+		return
+	}
+	c.editMu.Lock()
+	if c.editor != nil {
+		c.editor = nil
+		c.send([]byte{telnetIAC, telnetWONT, optEcho})
+	}
+	c.editMu.Unlock()
+}
+
+// IsTelnet reports whether telnet negotiation is used on this connection
+func (c *ClientConn) IsTelnet() bool {
+	return c.telnet
+}
+
+// terminalWidth returns the terminal width of a client, 0 if it is unknown
+func terminalWidth(conn net.Conn) int {
+	if c, ok := conn.(*ClientConn); ok {
+		width, _ := c.Terminal()
+		return width
+	}
+	return 0
+}
+
+// transportName describes how a client is connected
+func transportName(conn net.Conn) string {
+	c, ok := conn.(*ClientConn)
+	if !ok || !c.telnet {
+		return "tcp"
+	}
+
+	width, termType := c.Terminal()
+	details := []string{}
+	if termType != "" {
+		details = append(details, termType)
+	}
+	if width > 0 {
+		details = append(details, strconv.Itoa(width)+" columns")
+	}
+	if len(details) == 0 {
+		return "telnet"
+	}
+	return "telnet (" + strings.Join(details, ", ") + ")"
+}
@@ -0,0 +1,163 @@
+package utilities
+
+import (
+	"net"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Maximum length of a username in characters
+const MaxNameLength = 20
+
+// ReservedNames cannot be used as usernames in any letter case
+var ReservedNames = []string{"admin", "administrator", "server", "system", "root", "operator", "moderator"}
+
+// confusables maps Cyrillic and Greek letters to the Latin letter they look
+// like, so a name in another script cannot pass for a Latin one
+var confusables = map[rune]rune{
+	'а': 'a', 'в': 'b', 'ԁ': 'd', 'е': 'e', 'һ': 'h', 'і': 'i', 'ј': 'j', 'к': 'k',
+	'ӏ': 'l', 'м': 'm', 'н': 'h', 'о': 'o', 'р': 'p', 'ԛ': 'q', 'ѕ': 's', 'т': 't',
+	'у': 'y', 'ԝ': 'w', 'х': 'x', 'с': 'c', 'ү': 'y',
+	'α': 'a', 'β': 'b', 'ε': 'e', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p',
+	'τ': 't', 'υ': 'u', 'χ': 'x', 'ϲ': 'c',
+}
+
+// Scripts that are written together in one name, like Japanese kanji and kana
+var scriptGroups = map[string]string{
+	"Hiragana": "Han",
+	"Katakana": "Han",
+	"Hangul":   "Han",
+	"Bopomofo": "Han",
+}
+
+// NameKey returns the form of a name used to compare names, names that only
+// differ in letter case, Unicode normalization, width or look-alike letters of
+// other scripts have the same key
+func NameKey(name string) string {
+	return strings.Map(func(r rune) rune {
+		r = foldRune(r)
+		if latin, ok := confusables[r]; ok {
+			return latin
+		}
+		return r
+	}, norm.NFKC.String(name))
+}
+
+// foldRune maps a rune to one member of its case folding orbit, so K, k and the
+// Kelvin sign all become k
+func foldRune(r rune) rune {
+	folded := r
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		if f < folded {
+			folded = f
+		}
+	}
+	return unicode.ToLower(folded)
+}
+
+// sameName reports whether two names belong to the same user
+func sameName(a, b string) bool {
+	return NameKey(a) == NameKey(b)
+}
+
+// nameSyntaxProblem checks the length and characters of a name, it returns an
+// empty string for names that are well formed
+func nameSyntaxProblem(name string) string {
+	if name == "" || utf8.RuneCountInString(name) > MaxNameLength {
+		return "Name cannot be empty or more than 20 characters."
+	}
+	if !utf8.ValidString(name) {
+		return "Name must be valid UTF-8."
+	}
+
+	if !norm.NFC.IsNormalString(name) {
+		return "Name must be in Unicode normal form C."
+	}
+
+	var prev rune
+	var script string
+	for i, r := range name {
+		switch {
+		case unicode.IsLetter(r):
+			// Letters of different scripts in one name can imitate other names
+			if s := letterScript(r); script == "" {
+				script = s
+			} else if s != script {
+				return "Name cannot mix letters of different scripts."
+			}
+		case unicode.IsDigit(r):
+		case unicode.IsMark(r):
+			// Marks that NFC could not combine must still follow a letter
+			if i == 0 || !unicode.IsLetter(prev) && !unicode.IsMark(prev) {
+				return "Name cannot start with an accent or put one after a symbol."
+			}
+		case r == '_' || r == '-' || r == '.':
+			if i == 0 {
+				return "Name must start with a letter or a digit."
+			}
+		default:
+			return "Name can only contain letters, digits, '_', '-' and '.'."
+		}
+		prev = r
+	}
+	return ""
+}
+
+// letterScript returns the script a letter is written in
+func letterScript(r rune) string {
+	for name, table := range unicode.Scripts {
+		if name != "Common" && name != "Inherited" && unicode.Is(table, r) {
+			if group, ok := scriptGroups[name]; ok {
+				return group
+			}
+			return name
+		}
+	}
+	return ""
+}
+
+// isReservedName reports whether a name is one of the ReservedNames
+func isReservedName(name string) bool {
+	for _, reserved := range ReservedNames {
+		if sameName(name, reserved) {
+			return true
+		}
+	}
+	return false
+}
+
+// nameProblem explains why a client cannot use a name, it returns an empty string for valid names
+func nameProblem(conn net.Conn, name string) string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return checkName(conn, name)
+}
+
+// checkName explains why a client cannot use a name like nameProblem, mu must
+// be held so the name cannot be taken before the caller uses it
+func checkName(conn net.Conn, name string) string {
+	if problem := nameSyntaxProblem(name); problem != "" {
+		return problem
+	}
+	// Integrations are reserved too, so nobody can post as a webhook
+	if isReservedName(name) || integrationNamed(name) != nil {
+		return "This name is reserved, choose a different name."
+	}
+
+	// Registered names can be logged in to several times, the password is asked next
+	if IsRegistered(name) {
+		return ""
+	}
+
+	self := Clients[conn]
+	for _, info := range Clients {
+		if info != self && sameName(info.name, name) {
+			return "Username already exists, choose a different name."
+		}
+	}
+	return ""
+}
@@ -0,0 +1,181 @@
+package utilities
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Largest webhook request body accepted
+const maxWebhookBody = 4096
+
+// Integration is an external system allowed to post into the chat
+type Integration struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	Room  string `json:"room"`
+	Color string `json:"color"`
+}
+
+// webhookPayload is the JSON body of an incoming webhook
+type webhookPayload struct {
+	Text     string `json:"text"`
+	Username string `json:"username"`
+}
+
+// checkIntegrations validates the configured integrations
+func checkIntegrations(integrations []Integration) error {
+	names := make(map[string]bool)
+	for i, integration := range integrations {
+		if problem := nameSyntaxProblem(integration.Name); problem != "" {
+			return fmt.Errorf("integration %d has an invalid name: %s", i+1, problem)
+		}
+		if isReservedName(integration.Name) {
+			return fmt.Errorf("integration %s has a reserved name", integration.Name)
+		}
+		if names[integration.Name] {
+			return fmt.Errorf("integration %s is configured twice", integration.Name)
+		}
+		names[integration.Name] = true
+
+		if len(integration.Token) < 16 {
+			return fmt.Errorf("integration %s needs a token of at least 16 characters", integration.Name)
+		}
+		if integration.Room != "" && integration.Room != DefaultRoom {
+			return fmt.Errorf("integration %s uses unknown room %s", integration.Name, integration.Room)
+		}
+		if integration.Color != "" {
+			if color, _ := GetColorByChoice(integration.Color); color == "" {
+				return fmt.Errorf("integration %s uses unknown color %s", integration.Name, integration.Color)
+			}
+		}
+	}
+	return nil
+}
+
+// StartWebhookServer serves incoming webhooks when a webhook port is configured
+func StartWebhookServer() error {
+	if ServerConfig.WebhookPort == "" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hooks/message", handleIncomingWebhook)
+
+	listener, err := net.Listen("tcp", "0.0.0.0:"+ServerConfig.WebhookPort)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+	}
+
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			chatLogger.Log("error", "Webhook server stopped: "+err.Error())
+		}
+	}()
+	return nil
+}
+
+// findIntegration returns the integration a token belongs to
+func findIntegration(token string) *Integration {
+	for i := range ServerConfig.Integrations {
+		integration := &ServerConfig.Integrations[i]
+		if subtle.ConstantTimeCompare([]byte(token), []byte(integration.Token)) == 1 {
+			return integration
+		}
+	}
+	return nil
+}
+
+// integrationNamed returns the integration with a name, users can ignore it by that name
+func integrationNamed(name string) *Integration {
+	for i := range ServerConfig.Integrations {
+		if sameName(ServerConfig.Integrations[i].Name, name) {
+			return &ServerConfig.Integrations[i]
+		}
+	}
+	return nil
+}
+
+// writeWebhookResponse answers a webhook request with a small JSON object
+func writeWebhookResponse(w http.ResponseWriter, status int, response map[string]any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleIncomingWebhook posts the text of a webhook into the chat as a bot
+func handleIncomingWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeWebhookResponse(w, http.StatusMethodNotAllowed, map[string]any{"ok": false, "error": "use POST"})
+		return
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	integration := findIntegration(token)
+	if token == "" || integration == nil {
+		chatLogger.Log("error", "Rejected webhook from "+r.RemoteAddr+": invalid token")
+		writeWebhookResponse(w, http.StatusUnauthorized, map[string]any{"ok": false, "error": "invalid token"})
+		return
+	}
+
+	var payload webhookPayload
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxWebhookBody)).Decode(&payload); err != nil {
+		writeWebhookResponse(w, http.StatusBadRequest, map[string]any{"ok": false, "error": "invalid JSON body"})
+		return
+	}
+
+	text := strings.TrimSpace(SanitizeInput(payload.Text))
+	if text == "" || len(text) > MaxMessageLength {
+		writeWebhookResponse(w, http.StatusBadRequest, map[string]any{
+			"ok":    false,
+			"error": fmt.Sprintf("text must be between 1 and %d characters", MaxMessageLength),
+		})
+		return
+	}
+
+	// Bots may post under another name, but not as a reserved, registered or online user
+	name := strings.TrimSpace(SanitizeName(payload.Username))
+	if name == "" || sameName(name, integration.Name) {
+		name = integration.Name
+	} else if problem := webhookNameProblem(name); problem != "" {
+		writeWebhookResponse(w, http.StatusBadRequest, map[string]any{"ok": false, "error": problem})
+		return
+	}
+
+	color, colorCode := GetColorByChoice(integration.Color)
+	bot := &UserInfo{
+		name:        name,
+		color:       color,
+		colorCode:   colorCode,
+		room:        DefaultRoom,
+		bot:         true,
+		integration: integration.Name,
+	}
+
+	ev := chatEvent(bot, text)
+	ev.Bot = true
+	BroadCastBot(bot, FormatBotMessage(name, text), ev)
+	chatLogger.Log("connection", "Webhook "+integration.Name+" posted from "+r.RemoteAddr)
+
+	writeWebhookResponse(w, http.StatusOK, map[string]any{"ok": true, "id": ev.ID})
+}
+
+// webhookNameProblem explains why a webhook cannot post under a name, it
+// returns an empty string for names nobody else uses
+func webhookNameProblem(name string) string {
+	if IsRegistered(name) {
+		return "This name is registered, choose a different name."
+	}
+	return nameProblem(nil, name)
+}
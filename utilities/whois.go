@@ -0,0 +1,102 @@
+package utilities
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Oper gives operator rights to a user who knows the operator password
+func Oper(conn net.Conn, password string) {
+	// Wrong passwords count toward the same lockout as account passwords
+	ipAddr := remoteIP(conn)
+	if wait := passwordLockedFor(ipAddr); wait > 0 {
+		conn.Write([]byte(FormatErrorMessage(fmt.Sprintf("\nError: Too many wrong passwords, try again in %v.", wait)) + "\n"))
+		return
+	}
+	if ServerConfig.OperatorPassword == "" ||
+		subtle.ConstantTimeCompare([]byte(password), []byte(ServerConfig.OperatorPassword)) != 1 {
+		chatLogger.Log("connection", "Wrong operator password from "+conn.RemoteAddr().String())
+		if notePasswordFailure(ipAddr) {
+			chatLogger.Log("connection", "Too many wrong passwords from "+ipAddr+", locked out")
+		}
+		conn.Write([]byte(FormatErrorMessage("\nError: Invalid operator password.") + "\n"))
+		return
+	}
+	clearPasswordFailures(ipAddr)
+
+	mu.Lock()
+	client, exists := Clients[conn]
+	if exists {
+		client.operator = true
+		scheduleIdleCheck(conn, client)
+	}
+	mu.Unlock()
+
+	if exists {
+		conn.Write([]byte("You are now an operator\n"))
+		chatLogger.Log("connection", "User "+client.name+" "+client.ipAddr+" is now an operator")
+	}
+}
+
+// Whois shows the profile details of an online user
+func Whois(conn net.Conn, name string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	requester, exists := Clients[conn]
+	if !exists {
+		return
+	}
+
+	var target *UserInfo
+	var targetConn net.Conn
+	for client, info := range Clients {
+		// A session that is still connected tells more than a lost one
+		if sameName(info.name, name) && (target == nil || suspendedConn(targetConn)) {
+			target = info
+			targetConn = client
+		}
+	}
+	if target == nil {
+		conn.Write([]byte(FormatErrorMessage("\nError: User not found.") + "\n"))
+		return
+	}
+
+	now := time.Now()
+	status := target.status
+	if status == "" {
+		status = "-"
+	}
+	away := "no"
+	if target.away {
+		away = "yes"
+		if target.awayReason != "" {
+			away += " (" + target.awayReason + ")"
+		}
+	}
+
+	whois := fmt.Sprintf("\nWhois %s%s%s:\n", target.color, target.name, Reset)
+	whois += fmt.Sprintf("  Joined:        %s\n", localTime(conn, target.joinedAt))
+	whois += fmt.Sprintf("  Last activity: %s\n", localTime(conn, target.lastActive))
+	whois += fmt.Sprintf("  Idle:          %s\n", now.Sub(target.lastActive).Truncate(time.Second))
+	whois += fmt.Sprintf("  Away:          %s\n", away)
+	whois += fmt.Sprintf("  Status:        %s\n", status)
+	whois += fmt.Sprintf("  Room:          %s\n", target.room)
+	whois += fmt.Sprintf("  Transport:     %s\n", transportName(targetConn))
+	if reconnecting(target) {
+		whois += "  Reconnecting:  yes, the connection was lost\n"
+	}
+	if target.operator {
+		whois += "  Operator:      yes\n"
+	}
+
+	// Network details are only shown to operators
+	if requester.can(PermOperator) {
+		whois += fmt.Sprintf("  IP address:    %s\n", target.ipAddr)
+		whois += fmt.Sprintf("  Connections:   %d\n", connectionCounts[target.ipAddr])
+	}
+
+	conn.Write([]byte(whois + "\n"))
+}